@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.mills.io/prologic/go-gopher"
+	"github.com/ottopasuuna/viscacha/core"
+)
+
+const BOOKMARKS_URL = "about:bookmarks"
+
+// Lists every tag, linking to the bookmarks with that tag, which are at
+// BOOKMARKS_URL with the tag in a query like "?tag=news"
+const BOOKMARK_TAGS_URL = BOOKMARKS_URL + "?tags"
+const BOOKMARK_TAG_QUERY = "?tag="
+
+type Bookmark struct {
+	Title string   `json:"title"`
+	Url   string   `json:"url"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// Bookmarked pages, saved to a json file whenever they change
+type Bookmarks struct {
+	Entries []*Bookmark `json:"bookmarks"`
+	path    string
+}
+
+// Read the bookmarks file. If the file does not exist, return an empty list
+// that will be saved there.
+func LoadBookmarks(path string) *Bookmarks {
+	bookmarks := &Bookmarks{path: path}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bookmarks
+	}
+	if err != nil {
+		AppLog.Errorf("Failed to read bookmarks file \"%s\"\n\t%v", path, err)
+		return bookmarks
+	}
+	err = json.Unmarshal(content, bookmarks)
+	if err != nil {
+		AppLog.Errorf("Failed to parse bookmarks file \"%s\"\n\t%v", path, err)
+	}
+	return bookmarks
+}
+
+func (bookmarks *Bookmarks) Save() error {
+	content, err := json.MarshalIndent(bookmarks, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(bookmarks.path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bookmarks.path, content, 0644)
+}
+
+func (bookmarks *Bookmarks) Add(title string, url string, tags []string) {
+	bookmarks.Entries = append(bookmarks.Entries, &Bookmark{Title: title, Url: url, Tags: tags})
+}
+
+// Remove the bookmark at index. Returns false if there is no such bookmark
+func (bookmarks *Bookmarks) Remove(index int) bool {
+	if index < 0 || index >= len(bookmarks.Entries) {
+		return false
+	}
+	bookmarks.Entries = append(bookmarks.Entries[:index], bookmarks.Entries[index+1:]...)
+	return true
+}
+
+// Index of the first bookmark of url, or -1 if it isn't bookmarked
+func (bookmarks *Bookmarks) Find(url string) int {
+	for i, bookmark := range bookmarks.Entries {
+		if bookmark.Url == url {
+			return i
+		}
+	}
+	return -1
+}
+
+func (bookmark *Bookmark) HasTag(tag string) bool {
+	for _, bookmark_tag := range bookmark.Tags {
+		if bookmark_tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Every tag used by a bookmark, sorted, with the number of bookmarks using it
+func (bookmarks *Bookmarks) Tags() ([]string, map[string]int) {
+	counts := make(map[string]int)
+	var tags []string
+	for _, bookmark := range bookmarks.Entries {
+		for _, tag := range bookmark.Tags {
+			if counts[tag] == 0 {
+				tags = append(tags, tag)
+			}
+			counts[tag] += 1
+		}
+	}
+	sort.Strings(tags)
+	return tags, counts
+}
+
+// The bookmark page at _url, which is BOOKMARKS_URL, BOOKMARK_TAGS_URL or the
+// page of a tag. Returns nil for any other url.
+func (bookmarks *Bookmarks) Page(_url string) *core.Page {
+	switch {
+	case _url == BOOKMARKS_URL:
+		return bookmarks.ToPage()
+	case _url == BOOKMARK_TAGS_URL:
+		return bookmarks.TagsPage()
+	case strings.HasPrefix(_url, BOOKMARKS_URL+BOOKMARK_TAG_QUERY):
+		tag, err := url.QueryUnescape(strings.TrimPrefix(_url, BOOKMARKS_URL+BOOKMARK_TAG_QUERY))
+		if err != nil {
+			return nil
+		}
+		return bookmarks.TagPage(tag)
+	}
+	return nil
+}
+
+// Build a gopher directory page linking to every bookmark, so it can be
+// rendered and navigated like any other directory.
+func (bookmarks *Bookmarks) ToPage() *core.Page {
+	return bookmarksPage(bookmarks.Entries, BOOKMARKS_URL, "Bookmarks")
+}
+
+// A page like ToPage's, with only the bookmarks tagged with tag
+func (bookmarks *Bookmarks) TagPage(tag string) *core.Page {
+	var tagged []*Bookmark
+	for _, bookmark := range bookmarks.Entries {
+		if bookmark.HasTag(tag) {
+			tagged = append(tagged, bookmark)
+		}
+	}
+	return bookmarksPage(tagged, BOOKMARKS_URL+BOOKMARK_TAG_QUERY+url.QueryEscape(tag),
+		fmt.Sprintf("Bookmarks tagged %s", tag))
+}
+
+// A directory page linking to the page of each tag
+func (bookmarks *Bookmarks) TagsPage() *core.Page {
+	tags, counts := bookmarks.Tags()
+	dir := gopher.Directory{}
+	var links []*core.Link
+	for _, tag := range tags {
+		tag_url := BOOKMARKS_URL + BOOKMARK_TAG_QUERY + url.QueryEscape(tag)
+		description := fmt.Sprintf("%s (%d)", tag, counts[tag])
+		dir.Items = append(dir.Items, &gopher.Item{
+			Type:        gopher.DIRECTORY,
+			Description: description,
+			Selector:    tag_url,
+		})
+		links = append(links, &core.Link{Type: core.GopherDirectory, Url: tag_url, Description: description, ItemType: gopher.DIRECTORY})
+	}
+	content, _ := dir.ToText()
+	return &core.Page{
+		Type:    core.GopherDirectory,
+		Url:     BOOKMARK_TAGS_URL,
+		Title:   "Bookmark tags",
+		Content: string(content),
+		Links:   links,
+	}
+}
+
+func bookmarksPage(entries []*Bookmark, page_url string, title string) *core.Page {
+	dir := gopher.Directory{}
+	var links []*core.Link
+	for _, bookmark := range entries {
+		item_type := core.UrlItemType(bookmark.Url)
+		content_type, ok := core.Gopher_to_content_type[item_type]
+		if !ok {
+			content_type = core.UnknownType
+		}
+		dir.Items = append(dir.Items, &gopher.Item{
+			Type:        item_type,
+			Description: bookmark.Title,
+			Selector:    bookmark.Url,
+		})
+		links = append(links, &core.Link{Type: content_type, Url: bookmark.Url, Description: bookmark.Title, ItemType: item_type})
+	}
+	content, _ := dir.ToText()
+	return &core.Page{
+		Type:    core.GopherDirectory,
+		Url:     page_url,
+		Title:   title,
+		Content: string(content),
+		Links:   links,
+	}
+}
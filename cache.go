@@ -0,0 +1,79 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ottopasuuna/viscacha/core"
+)
+
+// Keeps the most recently fetched pages in memory so visiting them again
+// doesn't need a network round trip. Pages older than ttl are refetched.
+type PageCache struct {
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // Most recently used at the front
+	lock    sync.Mutex
+}
+
+type cacheEntry struct {
+	url     string
+	page    *core.Page
+	fetched time.Time
+}
+
+// Create a cache holding up to size pages. A size less than 1 disables caching
+func NewPageCache(size int, ttl time.Duration) *PageCache {
+	return &PageCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get a copy of the cached page for url, or nil if it isn't cached or has expired.
+// The copy has its own scroll position and place in the history.
+func (cache *PageCache) Get(url string) *core.Page {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[url]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Since(entry.fetched) > cache.ttl {
+		cache.order.Remove(element)
+		delete(cache.entries, url)
+		return nil
+	}
+	cache.order.MoveToFront(element)
+	page := *entry.page
+	page.ScrollOffset = 0
+	page.Parent = nil
+	page.LinkIndex = 0
+	return &page
+}
+
+func (cache *PageCache) Put(page *core.Page) {
+	if cache.size < 1 {
+		return
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[page.Url]; ok {
+		cache.order.Remove(element)
+	}
+	cache.entries[page.Url] = cache.order.PushFront(&cacheEntry{
+		url:     page.Url,
+		page:    page,
+		fetched: time.Now(),
+	})
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).url)
+	}
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Downloads run in the background, so loading a page never waits for a
+// big file to arrive
+
+// How often Config.DownloadProgress is called while a download is running
+const DOWNLOAD_PROGRESS_INTERVAL = 500 * time.Millisecond
+
+// A file being saved to the download directory
+type Download struct {
+	Url      string
+	Path     string
+	Started  time.Time
+	received int64 // Bytes saved so far, accessed atomically
+	progress func(download *Download)
+	finished func(download *Download) // Called once the file is saved
+	tracker  *Downloads               // Where the download is listed, if anywhere
+	lock     sync.Mutex
+	done     bool
+	err      error
+}
+
+// The downloads started with a Config, set in Config.Downloads by whoever
+// wants to list them or wait for them
+type Downloads struct {
+	lock      sync.Mutex
+	downloads []*Download
+	running   sync.WaitGroup
+}
+
+func NewDownloads() *Downloads {
+	return &Downloads{}
+}
+
+// Every download started so far, oldest first
+func (downloads *Downloads) Downloads() []*Download {
+	downloads.lock.Lock()
+	defer downloads.lock.Unlock()
+	return append([]*Download(nil), downloads.downloads...)
+}
+
+// Wait until every download started so far is over
+func (downloads *Downloads) WaitDownloads() {
+	downloads.running.Wait()
+}
+
+func (downloads *Downloads) add(download *Download) {
+	downloads.lock.Lock()
+	downloads.downloads = append(downloads.downloads, download)
+	downloads.lock.Unlock()
+	downloads.running.Add(1)
+}
+
+func (download *Download) Received() int64 {
+	return atomic.LoadInt64(&download.received)
+}
+
+// Whether the download is over, and the error it failed with if it did
+func (download *Download) Done() (bool, error) {
+	download.lock.Lock()
+	defer download.lock.Unlock()
+	return download.done, download.err
+}
+
+// Start saving body as fileName in config.DownloadDir in the background.
+// conn is closed once the download is over, unless it is nil. It is closed
+// right away if the file could not be created.
+func StartDownload(config *Config, _url string, fileName string, body io.Reader, conn io.Closer) (*Download, error) {
+	return startDownload(config, _url, fileName, body, conn, nil)
+}
+
+// Like StartDownload, but calls finished from the download's goroutine once
+// the file has been saved, unless it is nil or the download failed
+func startDownload(config *Config, _url string, fileName string, body io.Reader, conn io.Closer,
+	finished func(download *Download)) (*Download, error) {
+	downloadPath := uniqueFilePath(filepath.Join(config.DownloadDir, fileName))
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	download := &Download{Url: _url, Path: downloadPath, Started: time.Now(), progress: config.DownloadProgress,
+		finished: finished, tracker: config.Downloads}
+	if download.tracker != nil {
+		download.tracker.add(download)
+	}
+	appLog.Infof("Downloading %s to %s", _url, downloadPath)
+	go download.run(file, body, conn)
+	return download, nil
+}
+
+func (download *Download) run(file *os.File, body io.Reader, conn io.Closer) {
+	if download.tracker != nil {
+		defer download.tracker.running.Done()
+	}
+	if conn != nil {
+		defer conn.Close()
+	}
+	_, err := io.Copy(&progressWriter{file: file, download: download}, body)
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	download.lock.Lock()
+	download.done = true
+	download.err = err
+	download.lock.Unlock()
+	if err != nil {
+		appLog.Errorf("Download of %s failed: %v", download.Url, err)
+	} else {
+		appLog.Infof("Download saved to %s", download.Path)
+		if download.finished != nil {
+			download.finished(download)
+		}
+	}
+	if download.progress != nil {
+		download.progress(download)
+	}
+}
+
+// Counts the bytes written to a download's file
+type progressWriter struct {
+	file        io.Writer
+	download    *Download
+	last_update time.Time
+}
+
+func (writer *progressWriter) Write(p []byte) (int, error) {
+	n, err := writer.file.Write(p)
+	atomic.AddInt64(&writer.download.received, int64(n))
+	if writer.download.progress != nil && time.Since(writer.last_update) >= DOWNLOAD_PROGRESS_INTERVAL {
+		writer.last_update = time.Now()
+		writer.download.progress(writer.download)
+	}
+	return n, err
+}
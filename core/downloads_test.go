@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Serve response to every spartan request on a local port until the test ends
+func serveSpartan(t *testing.T, response string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					conn.Write([]byte(response))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSpartanDownload(t *testing.T) {
+	data := "\x00\x01binary data"
+	address := serveSpartan(t, "2 application/octet-stream\r\n"+data)
+	config := DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	config.Downloads = NewDownloads()
+	page, err := Fetch(config, "spartan://"+address+"/file.bin")
+	if err != nil || page != nil {
+		t.Fatalf("got %+v, %v, want the file downloaded", page, err)
+	}
+	config.Downloads.WaitDownloads()
+	saved, err := ioutil.ReadFile(filepath.Join(config.DownloadDir, "file.bin"))
+	if err != nil || string(saved) != data {
+		t.Errorf("saved %q (%v), want %q", saved, err, data)
+	}
+}
+
+// The audio player is started on the sound file once it has downloaded
+func TestGopherAudioPlayer(t *testing.T) {
+	address := serveGopher(t, func(address string, selector string) string {
+		return "RIFF sound"
+	})
+	config := DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	config.Downloads = NewDownloads()
+	played := filepath.Join(config.DownloadDir, "played")
+	config.AudioPlayer = "touch " + played
+	page, err := Fetch(config, "gopher://"+address+"/s/sound.wav")
+	if err != nil || page != nil {
+		t.Fatalf("got %+v, %v, want the file downloaded", page, err)
+	}
+	config.Downloads.WaitDownloads()
+	saved, err := ioutil.ReadFile(filepath.Join(config.DownloadDir, "sound.wav"))
+	if err != nil || string(saved) != "RIFF sound" {
+		t.Errorf("saved %q (%v)", saved, err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(played); err == nil {
+			return
+		}
+	}
+	t.Error("audio player was not started")
+}
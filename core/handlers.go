@@ -0,0 +1,1306 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"git.mills.io/prologic/go-gopher"
+	"github.com/op/go-logging"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+const DEFAULT_TIMEOUT = 15
+const DEFAULT_MAX_CONTENT_SIZE = 10 * 1024 * 1024
+
+var DEFAULT_DOWNLOAD_LOCAITON = fmt.Sprintf("%s/Downloads", os.Getenv("HOME"))
+
+// Errors are logged to the same module as the rest of viscacha, request
+// timings to a module of their own so they can be filtered out
+var appLog = logging.MustGetLogger("viscacha")
+var handler_log = logging.MustGetLogger("handler")
+
+// Settings that affect how pages are fetched
+type Config struct {
+	Timeout            int    // seconds
+	DownloadDir        string // Where content that isn't shown is saved
+	InsecureSkipVerify bool   // Accept any TLS certificate for gophers
+	Charset            string // Encoding of gopher text, like "cp437". Guessed if empty
+	InlineImages       bool   // Decode gopher images instead of downloading them
+	LogRequests        bool   // Log the time and size of every gopher request
+	MaxContentSize     int64  // Bytes of a gopher page to read, bigger files are downloaded
+	AudioPlayer        string // Program and arguments that play downloaded sound files
+	Decompress         bool   // Show gzipped gopher text files decompressed
+	// Bytes read from the network for the page being fetched are added to
+	// it, to show progress. Fetch counts into a counter of its own if nil.
+	Received *int64
+	// Called from a download's goroutine as it makes progress, at most every
+	// DOWNLOAD_PROGRESS_INTERVAL, and once more when it is over. viscacha
+	// uses it to refresh the downloads view.
+	DownloadProgress func(download *Download)
+	// Downloads started while fetching are added to it. They still run, but
+	// can't be listed or waited for, if it is nil.
+	Downloads *Downloads
+}
+
+// The settings to fetch with when the user has none
+func DefaultConfig() Config {
+	return Config{
+		Timeout:        DEFAULT_TIMEOUT,
+		DownloadDir:    DEFAULT_DOWNLOAD_LOCAITON,
+		MaxContentSize: DEFAULT_MAX_CONTENT_SIZE,
+	}
+}
+
+const GOPHER_DEFAULT_PORT = "70"
+
+// There is no port registered for gopher over TLS. Servers like geomyidae
+// tell TLS from plain gopher by the first byte on the same port 70, so urls
+// without a port work with them. Servers on another port, like 7070, have
+// it written in their urls.
+const GOPHERS_DEFAULT_PORT = "70"
+const GEMINI_DEFAULT_PORT = "1965"
+const GEMINI_MAX_REDIRECTS = 5
+const FINGER_DEFAULT_PORT = "79"
+const SPARTAN_DEFAULT_PORT = "300"
+const SPARTAN_MAX_REDIRECTS = 5
+
+// Appended to content when the server stopped sending part way through
+const TRUNCATED_MARKER = "[truncated: connection closed]"
+
+// Appended to directories longer than the max_content_size setting
+const TOO_LARGE_MARKER = "[truncated: larger than max_content_size]"
+
+// Local files bigger than this are downloaded instead of shown
+const FILE_MAX_TEXT_SIZE = 10 * 1024 * 1024
+
+// Images with more pixels than this are downloaded instead of shown, since
+// a small file can decode to an image that doesn't fit in memory
+const MAX_IMAGE_PIXELS = 4096 * 4096
+
+// Maps a url scheme to the Handler that fetches it. Handlers return the page,
+// or nil and no error when the content was downloaded instead of shown.
+var SchemeHandlers = map[string]func(context.Context, *Config, string) (*Page, error){
+	"gopher":  GopherHandler,
+	"gophers": GopherHandler,
+	"gemini":  GeminiHandler,
+	"finger":  FingerHandler,
+	"spartan": SpartanHandler,
+	"file":    FileHandler,
+}
+
+// Returned when a handler could not connect to the server at all, like on a
+// failed DNS lookup or a refused connection, so trying again may help
+type ConnectError struct {
+	Err error
+}
+
+func (err *ConnectError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ConnectError) Unwrap() error {
+	return err.Err
+}
+
+var invalidPercentPattern = regexp.MustCompile(`%([^0-9A-Fa-f]|[0-9A-Fa-f][^0-9A-Fa-f]|[0-9A-Fa-f]?$)`)
+
+// Parse a url, percent encoding what a person would type in a selector but
+// url.Parse rejects, like a % that doesn't start an escape.
+func parseUrl(_url string) (*url.URL, error) {
+	parsed_url, err := url.Parse(_url)
+	if err == nil {
+		return parsed_url, nil
+	}
+	fixed_url := invalidPercentPattern.ReplaceAllStringFunc(_url, func(match string) string {
+		return "%25" + match[1:]
+	})
+	fixed_url = strings.ReplaceAll(fixed_url, " ", "%20")
+	if parsed_url, fixed_err := url.Parse(fixed_url); fixed_err == nil {
+		return parsed_url, nil
+	}
+	return nil, err
+}
+
+// Fetch a url with the Handler registered for its scheme, returning the page
+// or why it couldn't be fetched. A nil page without an error means the
+// content was saved to config.DownloadDir.
+func Fetch(config Config, _url string) (*Page, error) {
+	return FetchContext(context.Background(), config, _url)
+}
+
+// Like Fetch, but the connection is closed as soon as ctx is canceled
+func FetchContext(ctx context.Context, config Config, _url string) (*Page, error) {
+	parsed_url, err := parseUrl(_url)
+	if err != nil {
+		return nil, err
+	}
+	handler, ok := SchemeHandlers[parsed_url.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("Protocol \"%s\" not supported", parsed_url.Scheme)
+	}
+	if config.Received == nil {
+		config.Received = new(int64)
+	}
+	page, err := handler(ctx, &config, _url)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return page, err
+}
+
+func GopherHandler(ctx context.Context, config *Config, _url string) (*Page, error) {
+	// Pasted urls may have spaces or a bare % in the selector
+	if _, err := url.Parse(_url); err != nil {
+		if parsed_url, err := parseUrl(_url); err == nil {
+			appLog.Infof("Encoded %s as %s", _url, parsed_url)
+			return GopherHandler(ctx, config, parsed_url.String())
+		}
+	}
+	if typed_url, item_type, ok := gopherAddItemType(_url); ok {
+		appLog.Infof("No item type in %s, assuming type %c", _url, item_type)
+		page, err := GopherHandler(ctx, config, typed_url)
+		// A file requested as a directory comes back with no parseable items
+		if page != nil && item_type == gopher.DIRECTORY && len(page.Links) == 0 && strings.TrimSpace(page.Content) == "" {
+			typed_url, _, _ = gopherAddItemTypeAs(_url, gopher.FILE)
+			appLog.Infof("%s is not a directory, trying it as a text file", _url)
+			return GopherHandler(ctx, config, typed_url)
+		}
+		return page, err
+	}
+	appLog.Info("Handling gopher url: ", _url)
+	if config.LogRequests {
+		defer logRequest(_url, time.Now(), config.Received, atomic.LoadInt64(config.Received))
+	}
+	res, raw, err := gopherGet(ctx, config, _url)
+	if err != nil {
+		return nil, err
+	}
+	if res.Body != nil {
+		// Downloads take the body over, leaving nil to close here
+		defer func() {
+			if res.Body != nil {
+				res.Body.Close()
+			}
+		}()
+	}
+	content_type, ok := Gopher_to_content_type[res.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unrecognized gopher item type %c", res.Type)
+	}
+	// Html items on the gopher server itself, rather than URL: links to the
+	// web, are shown as their source
+	if content_type == HTMLType {
+		content_type = TextType
+	}
+	var content string
+	var title string
+	var links []*Link
+	var link_lines []int
+	if content_type == TextType {
+		body := bufio.NewReader(res.Body)
+		text := io.Reader(body)
+		// What was read of body so far, to download the rest after it
+		var received io.Reader
+		var compressed bytes.Buffer
+		if config.Decompress && isGzip(body) {
+			gzip_reader, err := gzip.NewReader(io.TeeReader(body, &compressed))
+			if err != nil {
+				return nil, err
+			}
+			appLog.Infof("Decompressing gzipped %s", _url)
+			text = gzip_reader
+			received = &compressed
+		}
+		// Read one byte past the limit to tell if the file is bigger. For
+		// gzipped files that is the decompressed size, so a small file
+		// can't decompress to more than fits in memory.
+		body_txt, err := ioutil.ReadAll(io.LimitReader(text, config.MaxContentSize+1))
+		if int64(len(body_txt)) > config.MaxContentSize {
+			appLog.Warningf("%s is larger than %s, downloading it instead", _url,
+				FormatByteCount(config.MaxContentSize))
+			if received == nil {
+				received = bytes.NewReader(body_txt)
+			}
+			return nil, gopherDownload(config, _url, res, io.MultiReader(received, body), nil)
+		}
+		if err != nil && len(body_txt) == 0 {
+			return nil, fmt.Errorf("Failed to read file body: %v", err)
+		}
+		raw = body_txt
+		content = decodeText(body_txt, config.Charset)
+		// Show whatever arrived before the connection broke
+		if err != nil {
+			appLog.Warningf("Incomplete response from %s: %v", _url, err)
+			content = strings.TrimSuffix(content, "\n") + "\n" + TRUNCATED_MARKER + "\n"
+		}
+		title = UrlFileName(_url)
+	} else if content_type == GopherDirectory || content_type == GopherQuery {
+		dir_txt, err := res.Dir.ToText()
+		if err != nil {
+			return nil, fmt.Errorf("Error converting GopherDirectory to text: %v", err)
+		}
+		content = string(dir_txt)
+		title = gopherDirectoryTitle(&res.Dir)
+		links, link_lines = gopherMakeLinkMap(&res.Dir)
+		if strings.HasPrefix(_url, "gophers://") {
+			gophersLinks(links, _url)
+		}
+	} else if content_type == ImageType && config.InlineImages {
+		return gopherImagePage(config, _url, res)
+	} else if content_type == AudioType && config.AudioPlayer != "" {
+		return nil, gopherDownload(config, _url, res, res.Body, func(download *Download) {
+			playAudio(config.AudioPlayer, download.Path)
+		})
+	} else if content_type == BinaryType || content_type == ImageType || content_type == AudioType {
+		return nil, gopherDownload(config, _url, res, res.Body, nil)
+	}
+
+	return &Page{
+		Type:      content_type,
+		Url:       _url,
+		Title:     title,
+		Content:   content,
+		Raw:       raw,
+		Links:     links,
+		LinkLines: link_lines,
+	}, nil
+}
+
+// Whether the content about to be read from body starts like a gzip file.
+// Selectors ending in .gz aren't always compressed, some servers unpack them.
+func isGzip(body *bufio.Reader) bool {
+	magic, _ := body.Peek(2)
+	return bytes.Equal(magic, []byte{0x1f, 0x8b})
+}
+
+// Item types that can start the path of a gopher url
+const GOPHER_ITEM_TYPES = "0123456789+gIThisdp"
+
+// Pasted urls like gopher://host/somefile often leave out the item type.
+// Returns the url with a type guessed from its path, or false if it
+// already has one.
+func gopherAddItemType(_url string) (string, gopher.ItemType, bool) {
+	return gopherAddItemTypeAs(_url, 0)
+}
+
+// Like gopherAddItemType, but uses item_type instead of guessing if it isn't 0
+func gopherAddItemTypeAs(_url string, item_type gopher.ItemType) (string, gopher.ItemType, bool) {
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return _url, 0, false
+	}
+	path := strings.TrimPrefix(parsed_url.Path, "/")
+	if path == "" || gopherPathHasType(path) {
+		return _url, 0, false
+	}
+	if item_type == 0 {
+		item_type = gopherGuessItemType(path)
+	}
+	parsed_url.Path = "/" + string(item_type) + "/" + path
+	return parsed_url.String(), item_type, true
+}
+
+// Whether path (without its leading slash) starts with an item type. It is
+// only taken as a type when a slash follows, since "somefile" would otherwise
+// be read as a sound file with selector "omefile", and "2023/notes.txt" as a
+// CSO search.
+func gopherPathHasType(path string) bool {
+	if !strings.ContainsRune(GOPHER_ITEM_TYPES, rune(path[0])) {
+		return false
+	}
+	return len(path) == 1 || path[1] == '/'
+}
+
+// Guess the item type of a selector from its file extension
+func gopherGuessItemType(path string) gopher.ItemType {
+	if strings.HasSuffix(path, "/") {
+		return gopher.DIRECTORY
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case "":
+		return gopher.DIRECTORY
+	case ".txt", ".text", ".md", ".gmi", ".asc", ".nfo", ".csv", ".log", ".html", ".htm":
+		return gopher.FILE
+	case ".gif":
+		return gopher.GIF
+	case ".png", ".jpg", ".jpeg", ".bmp", ".webp":
+		return gopher.IMAGE
+	}
+	return gopher.BINARY
+}
+
+// Decode an image to show it inline. Images that are too big or in a format
+// that can't be decoded are downloaded instead. The size is read from the
+// header first, so nothing is decoded for images that are too big.
+func gopherImagePage(config *Config, _url string, res *gopher.Response) (*Page, error) {
+	image_data, err := ioutil.ReadAll(io.LimitReader(res.Body, config.MaxContentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image: %v", err)
+	}
+	var img image.Image
+	if int64(len(image_data)) > config.MaxContentSize {
+		err = fmt.Errorf("larger than %s", FormatByteCount(config.MaxContentSize))
+	} else if size, _, config_err := image.DecodeConfig(bytes.NewReader(image_data)); config_err != nil {
+		err = config_err
+	} else if int64(size.Width)*int64(size.Height) > MAX_IMAGE_PIXELS {
+		err = fmt.Errorf("%dx%d pixels is too many", size.Width, size.Height)
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(image_data))
+	}
+	if img == nil {
+		appLog.Warningf("Can't show %s inline (%v), downloading it instead", _url, err)
+		return nil, gopherDownload(config, _url, res, io.MultiReader(bytes.NewReader(image_data), res.Body), nil)
+	}
+	return &Page{
+		Type:  ImageType,
+		Url:   _url,
+		Title: UrlFileName(_url),
+		Image: img,
+	}, nil
+}
+
+// Download the rest of a gopher response in the background, reading it from
+// body, which is res.Body after whatever was already read of it. The
+// download closes res.Body and leaves nil in its place. finished is called
+// with the download once it is saved, if it isn't nil.
+func gopherDownload(config *Config, _url string, res *gopher.Response, body io.Reader, finished func(*Download)) error {
+	conn := res.Body
+	res.Body = nil
+	// The load is over once this returns, the download isn't
+	if timeout_conn, ok := conn.(*timeoutConn); ok {
+		timeout_conn.detach()
+	}
+	_, err := startDownload(config, _url, gopherDownloadName(_url), body, conn, finished)
+	return err
+}
+
+// Name to save a gopher file as, the last element of the selector
+func gopherDownloadName(_url string) string {
+	parse_url, err := url.Parse(_url)
+	if err != nil {
+		return "download"
+	}
+	file_path := strings.Split(parse_url.Path, "/")
+	return file_path[len(file_path)-1]
+}
+
+// Log how long fetching _url took and how much was added to received since
+// start_bytes. Deferred by handlers when the log_requests setting is on.
+func logRequest(_url string, start time.Time, received *int64, start_bytes int64) {
+	address := ""
+	if parsed_url, err := url.Parse(_url); err == nil {
+		address = gopherAddress(parsed_url)
+	}
+	n_bytes := atomic.LoadInt64(received) - start_bytes
+	handler_log.Infof("%s (%s): %s in %v", _url, address, FormatByteCount(n_bytes),
+		time.Since(start).Round(time.Millisecond))
+}
+
+// Format a number of bytes like "12.3 KB"
+func FormatByteCount(n_bytes int64) string {
+	switch {
+	case n_bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n_bytes)/(1<<20))
+	case n_bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n_bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n_bytes)
+}
+
+// Save body as fileName in config.DownloadDir.
+// Returns false if the file could not be saved
+func SaveDownload(config Config, fileName string, body io.Reader) bool {
+	if _, err := saveDownloadPath(&config, fileName, body); err != nil {
+		appLog.Error("Could not download file:")
+		appLog.Error(err)
+		return false
+	}
+	return true
+}
+
+// Like SaveDownload, but returns the path the file was saved to, or why it
+// could not be saved
+func saveDownloadPath(config *Config, fileName string, body io.Reader) (string, error) {
+	downloadPath := uniqueFilePath(filepath.Join(config.DownloadDir, fileName))
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, body)
+	if err != nil {
+		return "", err
+	}
+	appLog.Infof("Download saved to %s", downloadPath)
+	return downloadPath, nil
+}
+
+// Start audio_player, a program and its arguments, on the downloaded sound
+// file at downloadPath. The player runs in the background, without the
+// terminal.
+func playAudio(audio_player string, downloadPath string) {
+	player := strings.Fields(audio_player)
+	cmd := exec.Command(player[0], append(player[1:], downloadPath)...)
+	if err := cmd.Start(); err != nil {
+		appLog.Errorf("Failed to run audio player \"%s\": %v", audio_player, err)
+		return
+	}
+	appLog.Infof("Playing %s in %s", downloadPath, player[0])
+	go cmd.Wait()
+}
+
+// Convert text in the named charset to UTF-8. With no charset, or "auto",
+// text that isn't valid UTF-8 is assumed to be Latin-1.
+func decodeText(text []byte, charset string) string {
+	if charset == "" || charset == "auto" {
+		if utf8.Valid(text) {
+			return string(text)
+		}
+		charset = "iso-8859-1"
+	}
+	encoding, err := ianaindex.IANA.Encoding(charset)
+	if err != nil || encoding == nil {
+		appLog.Errorf("Unknown charset \"%s\"", charset)
+		return string(text)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(text)
+	if err != nil {
+		appLog.Errorf("Failed to decode text as %s: %v", charset, err)
+		return string(text)
+	}
+	return string(decoded)
+}
+
+// Number file_path like "name (1).ext", "name (2).ext"... until it doesn't
+// collide with an existing file.
+func uniqueFilePath(file_path string) string {
+	ext := filepath.Ext(file_path)
+	base := strings.TrimSuffix(file_path, ext)
+	unique_path := file_path
+	for i := 1; ; i++ {
+		if _, err := os.Stat(unique_path); os.IsNotExist(err) {
+			return unique_path
+		}
+		unique_path = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// The last element of a url's path, or "" if it has none
+func UrlFileName(_url string) string {
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return ""
+	}
+	name := path.Base(parsed_url.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// Gopher directories usually start with a banner of info lines. Use the
+// first one with any text in it as the title.
+func gopherDirectoryTitle(dir *gopher.Directory) string {
+	for _, item := range dir.Items {
+		if item.Type != gopher.INFO {
+			continue
+		}
+		if title := strings.TrimSpace(item.Description); title != "" {
+			return title
+		}
+	}
+	return ""
+}
+
+// The text of the first heading in a gemtext document, or "" if it has none
+func gemtextTitle(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "#") {
+			return strings.TrimSpace(strings.TrimLeft(line, "#"))
+		}
+	}
+	return ""
+}
+
+// The host:port to connect to for a gopher url
+func gopherAddress(parsed_url *url.URL) string {
+	port := parsed_url.Port()
+	if port == "" && parsed_url.Scheme == "gophers" {
+		port = GOPHERS_DEFAULT_PORT
+	} else if port == "" {
+		port = GOPHER_DEFAULT_PORT
+	}
+	return net.JoinHostPort(parsed_url.Hostname(), port)
+}
+
+// Fetch a gopher resource like gopher.Get does, but give up when connecting to
+// or hearing back from the server takes longer than config.Timeout. Along
+// with a directory, the bytes it was parsed from are returned.
+func gopherGet(ctx context.Context, config *Config, _url string) (*gopher.Response, []byte, error) {
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	use_tls := parsed_url.Scheme == "gophers"
+	address := gopherAddress(parsed_url)
+
+	item_type, selector, search_term := SplitGopherUrl(parsed_url)
+	if item_type == 0 {
+		item_type = gopher.DIRECTORY
+	}
+	if search_term != "" {
+		selector += "\t" + search_term
+	}
+
+	var conn net.Conn
+	if use_tls {
+		tls_config := &tls.Config{
+			InsecureSkipVerify: config.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		}
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: tls_config}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, nil, &ConnectError{certificateError(timeoutError(err, address, timeout), address)}
+		}
+	} else {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, nil, &ConnectError{timeoutError(err, address, timeout)}
+		}
+	}
+	body := &timeoutConn{conn: conn, address: address, timeout: timeout, received: config.Received,
+		stop: closeOnCancel(ctx, conn)}
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err = conn.Write([]byte(selector + gopher.CRLF))
+	if err != nil {
+		body.Close()
+		return nil, nil, timeoutError(err, address, timeout)
+	}
+
+	res := &gopher.Response{Type: item_type}
+	if item_type != gopher.DIRECTORY && item_type != gopher.INDEXSEARCH {
+		res.Body = body
+		return res, nil, nil
+	}
+	defer body.Close()
+	var items []*gopher.Item
+	limited_body := &io.LimitedReader{R: body, N: config.MaxContentSize + 1}
+	var raw bytes.Buffer
+	scanner := bufio.NewScanner(io.TeeReader(limited_body, &raw))
+	for scanner.Scan() {
+		line := strings.Trim(decodeText(scanner.Bytes(), config.Charset), "\r\n")
+		if len(line) == 0 {
+			continue
+		}
+		if line == "." {
+			break
+		}
+		item, err := gopher.ParseItem(line)
+		if err != nil {
+			appLog.Debugf("Skipping malformed gopher item %q: %v", line, err)
+			continue
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		if len(items) == 0 {
+			return nil, nil, err
+		}
+		// Show whatever arrived before the connection broke
+		appLog.Warningf("Incomplete response from %s: %v", address, err)
+		items = append(items, &gopher.Item{Type: gopher.INFO, Description: TRUNCATED_MARKER})
+	} else if limited_body.N == 0 {
+		// The last line was most likely cut off part way
+		if len(items) > 0 {
+			items = items[:len(items)-1]
+		}
+		appLog.Warningf("Directory from %s is larger than %s, the rest is not shown", address,
+			FormatByteCount(config.MaxContentSize))
+		items = append(items, &gopher.Item{Type: gopher.INFO, Description: TOO_LARGE_MARKER})
+	}
+	res.Dir = gopher.Directory{Items: items}
+	return res, raw.Bytes(), nil
+}
+
+// A connection that fails reads once the server has been silent for longer
+// than timeout. The deadline is pushed back on every read, so slow but steady
+// transfers are not cut off.
+type timeoutConn struct {
+	conn     net.Conn
+	address  string
+	timeout  time.Duration
+	received *int64 // Counts the bytes read for the fetch, nil once detached
+	stop     func() // Stops closeOnCancel watching the connection, if it is
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	n, err := c.conn.Read(p)
+	if c.received != nil {
+		atomic.AddInt64(c.received, int64(n))
+	}
+	return n, timeoutError(err, c.address, c.timeout)
+}
+
+// Keep the connection open after the load it was made for is over, for
+// reading it in a background download. What is read from then on isn't
+// counted towards the load.
+func (c *timeoutConn) detach() {
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
+	c.received = nil
+}
+
+func (c *timeoutConn) Close() error {
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
+	return c.conn.Close()
+}
+
+// Close conn when ctx is canceled, so reads and writes blocked on it return
+// right away. The returned function stops watching ctx, and must be called
+// once the connection is no longer used. conn isn't closed after it returns.
+func closeOnCancel(ctx context.Context, conn io.Closer) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Replace network timeout errors with a message saying which host timed out
+func timeoutError(err error, address string, timeout time.Duration) error {
+	if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+		return fmt.Errorf("Connection to %s timed out after %v", address, timeout)
+	}
+	return err
+}
+
+// Explain certificate verification failures, which are common with the
+// self-signed certificates used by many servers
+func certificateError(err error, address string) error {
+	var unknown_authority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknown_authority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return fmt.Errorf("Certificate for %s not trusted: %v (set \"insecure_skip_verify\" to connect anyway)", address, err)
+	}
+	return err
+}
+
+// Split a gopher url into its item type, selector and search term. The
+// search term follows the selector after a tab, or is given as the query
+// string. The item type is 0 if the url has no path.
+func SplitGopherUrl(parsed_url *url.URL) (gopher.ItemType, string, string) {
+	var item_type gopher.ItemType
+	selector := strings.TrimPrefix(parsed_url.Path, "/")
+	if len(selector) > 0 {
+		item_type = gopher.ItemType(selector[0])
+		selector = selector[1:]
+	}
+	search_term := ""
+	if tab := strings.Index(selector, "\t"); tab >= 0 {
+		selector, search_term = selector[:tab], selector[tab+1:]
+	} else if parsed_url.RawQuery != "" {
+		// Sent decoded, like the path
+		var err error
+		search_term, err = url.PathUnescape(parsed_url.RawQuery)
+		if err != nil {
+			search_term = parsed_url.RawQuery
+		}
+	}
+	return item_type, selector, search_term
+}
+
+// Put a gopher url back together from the parts SplitGopherUrl gives.
+// url.URL percent encodes the tab and anything special in the selector or
+// search term, so they survive being parsed again.
+func JoinGopherUrl(scheme string, host string, item_type gopher.ItemType, selector string, search_term string) string {
+	gopher_url := url.URL{Scheme: scheme, Host: host}
+	if item_type != 0 {
+		gopher_url.Path = "/" + string(item_type) + selector
+	}
+	if search_term != "" {
+		gopher_url.Path += "\t" + search_term
+	}
+	return gopher_url.String()
+}
+
+// Whether _url is a gopher search selector (type 7) without a search term
+func GopherQueryNeedsInput(_url string) bool {
+	parsed_url, err := url.Parse(_url)
+	if err != nil || (parsed_url.Scheme != "gopher" && parsed_url.Scheme != "gophers") {
+		return false
+	}
+	item_type, _, search_term := SplitGopherUrl(parsed_url)
+	return item_type == gopher.INDEXSEARCH && search_term == ""
+}
+
+// The url of the results of searching the query selector at link for
+// search_term. The search term follows the selector after a tab, and the
+// results are a directory.
+func GopherQueryUrl(link *Link, search_term string) (string, error) {
+	if strings.TrimSpace(search_term) == "" {
+		return "", errors.New("Empty search term")
+	}
+	link_url, err := url.Parse(link.Url)
+	if err != nil {
+		return "", err
+	}
+	// Whatever item type and search term the link has are replaced
+	_, selector, _ := SplitGopherUrl(link_url)
+	return JoinGopherUrl(link_url.Scheme, link_url.Host, gopher.DIRECTORY, selector, search_term), nil
+}
+
+func gopherItemToUrl(item *gopher.Item) string {
+	// By convention, links to other protocols are given as "URL:<url>" selectors
+	if strings.HasPrefix(item.Selector, "URL:") {
+		return strings.TrimPrefix(item.Selector, "URL:")
+	}
+	// go-gopher uses url.Parse internally which doesn't handle some spaces in
+	// urls I encountered with gophernicus
+	cleaned_selector := strings.ReplaceAll(item.Selector, "#040", " ")
+	// The default port is left out, as is a missing one. IPv6 addresses
+	// need brackets either way, and some servers already add them.
+	host := strings.TrimSuffix(strings.TrimPrefix(item.Host, "["), "]")
+	if port := strconv.Itoa(item.Port); item.Port > 0 && port != GOPHER_DEFAULT_PORT {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	// Let url.URL percent encode spaces, tabs and such in the selector
+	item_url := url.URL{
+		Scheme: "gopher",
+		Host:   host,
+		Path:   "/" + string(item.Type) + cleaned_selector,
+	}
+	return item_url.String()
+}
+
+// Links from a gophers page back to the same server are fetched over TLS too
+func gophersLinks(links []*Link, page_url string) {
+	page, err := url.Parse(page_url)
+	if err != nil {
+		return
+	}
+	page_port := page.Port()
+	if page_port == "" {
+		page_port = GOPHERS_DEFAULT_PORT
+	}
+	for _, link := range links {
+		link_url, err := url.Parse(link.Url)
+		if err != nil || link_url.Scheme != "gopher" {
+			continue
+		}
+		link_port := link_url.Port()
+		if link_port == "" {
+			link_port = GOPHER_DEFAULT_PORT
+		}
+		if link_url.Hostname() == page.Hostname() && link_port == page_port {
+			link.Url = "gophers" + strings.TrimPrefix(link.Url, "gopher")
+		}
+	}
+}
+
+// Urls written out in the text of info lines
+var infoLinkPattern = regexp.MustCompile(`(gophers?|gemini|https?|finger)://[^\s<>"']+`)
+
+// The urls in an info line's text, without punctuation following them
+func FindInfoLinks(description string) [][]int {
+	matches := infoLinkPattern.FindAllStringIndex(description, -1)
+	for _, match := range matches {
+		match[1] = match[0] + len(strings.TrimRight(description[match[0]:match[1]], ".,;:!?)]"))
+	}
+	return matches
+}
+
+// The link to a url found in an info line
+func InfoLink(link_url string) *Link {
+	return &Link{Type: UrlContentType(link_url), Url: link_url, Description: link_url}
+}
+
+// Guess what kind of content a url points to from its scheme, and the item
+// type for gopher urls
+func UrlContentType(_url string) ContentType {
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return UnknownType
+	}
+	switch parsed_url.Scheme {
+	case "gopher", "gophers":
+		if content_type, ok := Gopher_to_content_type[UrlItemType(_url)]; ok {
+			return content_type
+		}
+	case "gemini", "spartan":
+		return GemtextType
+	case "http", "https":
+		return HTMLType
+	}
+	return UnknownType
+}
+
+// Guess the gopher item type a url points to, used to display non gopher
+// urls in a gopher directory.
+func UrlItemType(_url string) gopher.ItemType {
+	parsed_url, err := url.Parse(_url)
+	if err != nil || (parsed_url.Scheme != "gopher" && parsed_url.Scheme != "gophers") || len(parsed_url.Path) < 2 {
+		return gopher.DIRECTORY
+	}
+	return gopher.ItemType(parsed_url.Path[1])
+}
+
+// The links of a directory, and the index of the item each one is on, which
+// is also the line it is on. Urls in info lines are left for the renderer
+// to find, so they follow its detect_info_links setting.
+func gopherMakeLinkMap(dir *gopher.Directory) ([]*Link, []int) {
+	var link_map []*Link
+	var link_lines []int
+	for line, item := range dir.Items {
+		if item.Type != gopher.INFO {
+			content_type, ok := Gopher_to_content_type[item.Type]
+			if !ok {
+				content_type = UnknownType
+			}
+			link_map = append(link_map, &Link{Type: content_type,
+				Url: gopherItemToUrl(item), Description: item.Description, ItemType: item.Type})
+			link_lines = append(link_lines, line)
+		}
+	}
+	return link_map, link_lines
+}
+
+// An item of a gopher directory page, with the links it was given
+type GopherDirectoryItem struct {
+	Line  string
+	Item  *gopher.Item
+	Links []*Link
+}
+
+// The items of a directory page in the order they are listed, paired with
+// their links by the line each link is on. Info lines are left out.
+func GopherDirectoryItems(page *Page) []GopherDirectoryItem {
+	var items []GopherDirectoryItem
+	link_index := 0
+	for line_num, line := range strings.Split(page.Content, "\n") {
+		first_link := link_index
+		for link_index < len(page.Links) && link_index < len(page.LinkLines) && page.LinkLines[link_index] == line_num {
+			link_index++
+		}
+		item, err := gopher.ParseItem(line)
+		if err != nil || item.Type == gopher.INFO {
+			continue
+		}
+		items = append(items, GopherDirectoryItem{Line: line, Item: item, Links: page.Links[first_link:link_index]})
+	}
+	return items
+}
+
+// A copy of a directory page listing only items, with links renumbered
+// to match
+func GopherDirectoryPage(page *Page, title string, items []GopherDirectoryItem) *Page {
+	var lines []string
+	var links []*Link
+	var link_lines []int
+	for line_num, item := range items {
+		lines = append(lines, item.Line)
+		links = append(links, item.Links...)
+		for range item.Links {
+			link_lines = append(link_lines, line_num)
+		}
+	}
+	return &Page{
+		Type:      page.Type,
+		Url:       page.Url,
+		Title:     title,
+		Content:   strings.Join(lines, "\n") + "\n",
+		Links:     links,
+		LinkLines: link_lines,
+		Parent:    page.Parent,
+		LinkIndex: page.LinkIndex,
+	}
+}
+
+func GeminiHandler(ctx context.Context, config *Config, _url string) (*Page, error) {
+	appLog.Info("Handling gemini url: ", _url)
+	return geminiFetch(ctx, _url, 0)
+}
+
+func geminiFetch(ctx context.Context, _url string, redirects int) (*Page, error) {
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return nil, err
+	}
+	host := parsed_url.Host
+	if parsed_url.Port() == "" {
+		host = net.JoinHostPort(parsed_url.Hostname(), GEMINI_DEFAULT_PORT)
+	}
+	// Gemini servers mostly use self signed certificates, so they can't be
+	// verified against the system CAs.
+	dialer := &tls.Dialer{Config: &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, &ConnectError{err}
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	_, err = conn.Write([]byte(_url + "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Response header is "<STATUS><SPACE><META><CR><LF>"
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read gemini response header: %v", err)
+	}
+	header = strings.TrimRight(header, "\r\n")
+	if len(header) < 2 {
+		return nil, fmt.Errorf("Malformed gemini response header \"%s\"", header)
+	}
+	status := header[:2]
+	meta := strings.TrimSpace(header[2:])
+
+	switch status[0] {
+	case '2':
+		mime_type := strings.TrimSpace(strings.Split(meta, ";")[0])
+		var content_type ContentType
+		if mime_type == "" || mime_type == "text/gemini" {
+			content_type = GemtextType
+		} else if strings.HasPrefix(mime_type, "text/") {
+			content_type = TextType
+		} else {
+			return nil, fmt.Errorf("Unsupported gemini mime type \"%s\"", mime_type)
+		}
+		body_txt, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read gemini response body: %v", err)
+		}
+		title := UrlFileName(_url)
+		if content_type == GemtextType {
+			if heading := gemtextTitle(string(body_txt)); heading != "" {
+				title = heading
+			}
+		}
+		return &Page{
+			Type:    content_type,
+			Url:     _url,
+			Title:   title,
+			Content: string(body_txt),
+			Raw:     body_txt,
+		}, nil
+	case '3':
+		if redirects >= GEMINI_MAX_REDIRECTS {
+			return nil, fmt.Errorf("Too many redirects, stopped at %s", _url)
+		}
+		redirect_url, err := parsed_url.Parse(meta)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redirect url \"%s\"", meta)
+		}
+		if redirect_url.Scheme != "gemini" {
+			return nil, fmt.Errorf("Refusing to follow redirect to %s", redirect_url)
+		}
+		appLog.Info("Redirected to ", redirect_url)
+		return geminiFetch(ctx, redirect_url.String(), redirects+1)
+	case '4', '5':
+		return nil, fmt.Errorf("Gemini error %s: %s", status, meta)
+	default:
+		return nil, fmt.Errorf("Unsupported gemini response status %s: %s", status, meta)
+	}
+}
+
+func SpartanHandler(ctx context.Context, config *Config, _url string) (*Page, error) {
+	appLog.Info("Handling spartan url: ", _url)
+	return spartanFetch(ctx, config, _url, 0)
+}
+
+func spartanFetch(ctx context.Context, config *Config, _url string, redirects int) (*Page, error) {
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return nil, err
+	}
+	port := parsed_url.Port()
+	if port == "" {
+		port = SPARTAN_DEFAULT_PORT
+	}
+	address := net.JoinHostPort(parsed_url.Hostname(), port)
+	request_path := parsed_url.EscapedPath()
+	if request_path == "" {
+		request_path = "/"
+	}
+	// The query string is sent as the request body, like form input
+	data, err := url.QueryUnescape(parsed_url.RawQuery)
+	if err != nil {
+		data = parsed_url.RawQuery
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, &ConnectError{timeoutError(err, address, timeout)}
+	}
+	body := &timeoutConn{conn: conn, address: address, timeout: timeout, received: config.Received,
+		stop: closeOnCancel(ctx, conn)}
+	// Downloads take the connection over
+	downloading := false
+	defer func() {
+		if !downloading {
+			body.Close()
+		}
+	}()
+	// Request is "<HOST> <PATH> <CONTENT-LENGTH><CR><LF><DATA>"
+	request := fmt.Sprintf("%s %s %d\r\n%s", parsed_url.Hostname(), request_path, len(data), data)
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		return nil, err
+	}
+
+	// Response header is "<STATUS><SPACE><META><CR><LF>"
+	reader := bufio.NewReader(body)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read spartan response header: %v", err)
+	}
+	header = strings.TrimRight(header, "\r\n")
+	if len(header) < 1 {
+		return nil, fmt.Errorf("Malformed spartan response header \"%s\"", header)
+	}
+	status := header[:1]
+	meta := strings.TrimSpace(header[1:])
+
+	switch status[0] {
+	case '2':
+		mime_type := strings.TrimSpace(strings.Split(meta, ";")[0])
+		var content_type ContentType
+		if mime_type == "" || mime_type == "text/gemini" {
+			content_type = GemtextType
+		} else if strings.HasPrefix(mime_type, "text/") {
+			content_type = TextType
+		} else {
+			file_name := UrlFileName(_url)
+			if file_name == "" {
+				file_name = parsed_url.Hostname()
+			}
+			// The load is over once this returns, the download isn't
+			body.detach()
+			downloading = true
+			_, err := StartDownload(config, _url, file_name, reader, body)
+			return nil, err
+		}
+		body_txt, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read spartan response body: %v", err)
+		}
+		title := UrlFileName(_url)
+		if content_type == GemtextType {
+			if heading := gemtextTitle(string(body_txt)); heading != "" {
+				title = heading
+			}
+		}
+		return &Page{
+			Type:    content_type,
+			Url:     _url,
+			Title:   title,
+			Content: string(body_txt),
+			Raw:     body_txt,
+		}, nil
+	case '3':
+		// Redirects are to a path on the same server
+		if redirects >= SPARTAN_MAX_REDIRECTS {
+			return nil, fmt.Errorf("Too many redirects, stopped at %s", _url)
+		}
+		redirect_url, err := parsed_url.Parse(meta)
+		if err != nil || redirect_url.Host != parsed_url.Host {
+			return nil, fmt.Errorf("Invalid redirect \"%s\"", meta)
+		}
+		appLog.Info("Redirected to ", redirect_url)
+		return spartanFetch(ctx, config, redirect_url.String(), redirects+1)
+	case '4', '5':
+		return nil, fmt.Errorf("Spartan error %s: %s", status, meta)
+	default:
+		return nil, fmt.Errorf("Unsupported spartan response status %s: %s", status, meta)
+	}
+}
+
+func FingerHandler(ctx context.Context, config *Config, _url string) (*Page, error) {
+	appLog.Info("Handling finger url: ", _url)
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return nil, err
+	}
+	host := parsed_url.Host
+	if parsed_url.Port() == "" {
+		host = net.JoinHostPort(parsed_url.Hostname(), FINGER_DEFAULT_PORT)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, &ConnectError{err}
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	// An empty username asks the server for a listing of its users
+	username := strings.TrimPrefix(parsed_url.Path, "/")
+	_, err = conn.Write([]byte(username + "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	body_txt, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read finger response: %v", err)
+	}
+	title := parsed_url.Hostname()
+	if username != "" {
+		title = username + "@" + title
+	}
+	return &Page{
+		Type:    TextType,
+		Url:     _url,
+		Title:   title,
+		Content: string(body_txt),
+		Raw:     body_txt,
+	}, nil
+}
+
+// Show a local text file, or list a directory as a gopher directory linking
+// to its entries. Big or binary files are copied to the download directory.
+func FileHandler(ctx context.Context, config *Config, _url string) (*Page, error) {
+	appLog.Info("Handling file url: ", _url)
+	parsed_url, err := url.Parse(_url)
+	if err != nil {
+		return nil, err
+	}
+	file_path := parsed_url.Path
+	info, err := os.Stat(file_path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return fileDirectoryPage(_url, file_path)
+	}
+
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := file.Read(head)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if info.Size() > FILE_MAX_TEXT_SIZE || bytes.IndexByte(head[:n], 0) >= 0 {
+		appLog.Infof("%s is not a text file, downloading it", file_path)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		_, err := saveDownloadPath(config, filepath.Base(file_path), file)
+		return nil, err
+	}
+	rest, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file: %v", err)
+	}
+	return &Page{
+		Type:    TextType,
+		Url:     _url,
+		Title:   filepath.Base(file_path),
+		Content: string(head[:n]) + string(rest),
+	}, nil
+}
+
+// List the entries of the directory dir_path, with a link to its parent first
+func fileDirectoryPage(_url string, dir_path string) (*Page, error) {
+	entries, err := ioutil.ReadDir(dir_path)
+	if err != nil {
+		return nil, err
+	}
+	dir := gopher.Directory{}
+	var links []*Link
+	var link_lines []int
+	add_entry := func(name string, entry_path string, is_dir bool) {
+		item_type := gopher.FILE
+		var content_type ContentType = TextType
+		if is_dir {
+			item_type, content_type = gopher.DIRECTORY, GopherDirectory
+		}
+		entry_url := (&url.URL{Scheme: "file", Path: entry_path}).String()
+		dir.Items = append(dir.Items, &gopher.Item{
+			Type:        item_type,
+			Description: name,
+			Selector:    entry_url,
+		})
+		links = append(links, &Link{Type: content_type, Url: entry_url, Description: name, ItemType: item_type})
+		link_lines = append(link_lines, len(link_lines))
+	}
+	if parent := filepath.Dir(dir_path); parent != dir_path {
+		add_entry("..", parent, true)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		add_entry(name, filepath.Join(dir_path, entry.Name()), entry.IsDir())
+	}
+	content, err := dir.ToText()
+	if err != nil {
+		return nil, err
+	}
+	return &Page{
+		Type:      GopherDirectory,
+		Url:       _url,
+		Title:     dir_path,
+		Content:   string(content),
+		Links:     links,
+		LinkLines: link_lines,
+	}, nil
+}
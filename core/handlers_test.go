@@ -0,0 +1,632 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/go-gopher"
+)
+
+// Serve gopher requests on a local port until the test ends. The response
+// to each selector is made by respond, given the server's host and port.
+func serveGopher(t *testing.T, respond func(address string, selector string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	address := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				selector, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(respond(address, strings.TrimRight(selector, "\r\n"))))
+			}()
+		}
+	}()
+	return address
+}
+
+const testText = "Hello from gopher\nSecond line\n"
+
+// A directory at the root linking to a text file, and the text file
+func testGopherServer(t *testing.T) string {
+	return serveGopher(t, func(address string, selector string) string {
+		host, port, _ := net.SplitHostPort(address)
+		switch selector {
+		case "", "/":
+			return "iWelcome to the test server\tfake\t(NULL)\t0\r\n" +
+				fmt.Sprintf("0Hello text\t/hello.txt\t%s\t%s\r\n", host, port) +
+				".\r\n"
+		case "/hello.txt":
+			return testText
+		}
+		return "3Not found\t\terror.host\t1\r\n.\r\n"
+	})
+}
+
+func TestFetchGopherDirectory(t *testing.T) {
+	address := testGopherServer(t)
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Type != GopherDirectory {
+		t.Errorf("Type = %v, want %v", page.Type, ContentType(GopherDirectory))
+	}
+	if page.Title != "Welcome to the test server" {
+		t.Errorf("Title = %q", page.Title)
+	}
+	if len(page.Links) != 1 {
+		t.Fatalf("got %d links, want 1", len(page.Links))
+	}
+	want_url := "gopher://" + address + "/0/hello.txt"
+	if page.Links[0].Url != want_url || page.Links[0].Description != "Hello text" {
+		t.Errorf("link = %q %q, want %q \"Hello text\"", page.Links[0].Url, page.Links[0].Description, want_url)
+	}
+}
+
+func TestFetchGopherText(t *testing.T) {
+	address := testGopherServer(t)
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/0/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Type != TextType || page.Content != testText || page.Title != "hello.txt" {
+		t.Errorf("got %v %q %q", page.Type, page.Title, page.Content)
+	}
+}
+
+// Html items on the gopher server are fetched over gopher and shown as text
+func TestFetchGopherHtml(t *testing.T) {
+	address := serveGopher(t, func(address string, selector string) string {
+		return "<p>Hello</p>\n"
+	})
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/h/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Type != TextType || page.Content != "<p>Hello</p>\n" {
+		t.Errorf("got %v %q", page.Type, page.Content)
+	}
+}
+
+// Fetches running at the same time each count their own bytes
+func TestFetchConcurrent(t *testing.T) {
+	address := testGopherServer(t)
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			config := DefaultConfig()
+			config.Received = new(int64)
+			page, err := Fetch(config, "gopher://"+address+"/0/hello.txt")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if page.Content != testText {
+				t.Errorf("Content = %q", page.Content)
+			}
+			if n := atomic.LoadInt64(config.Received); n != int64(len(testText)) {
+				t.Errorf("Received %d bytes, want %d", n, len(testText))
+			}
+		}()
+	}
+	wait.Wait()
+}
+
+func TestFetchConnectError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, err = Fetch(DefaultConfig(), "gopher://"+address+"/1/")
+	if _, ok := err.(*ConnectError); !ok {
+		t.Errorf("got error %#v, want a *ConnectError", err)
+	}
+}
+
+func TestGopherAddItemType(t *testing.T) {
+	tests := []struct {
+		url       string
+		want      string
+		want_type gopher.ItemType
+		added     bool
+	}{
+		{"gopher://host", "gopher://host", 0, false},
+		{"gopher://host/", "gopher://host/", 0, false},
+		{"gopher://host/somefile", "gopher://host/1/somefile", gopher.DIRECTORY, true},
+		{"gopher://host/notes.txt", "gopher://host/0/notes.txt", gopher.FILE, true},
+		{"gopher://host/2023/notes.txt", "gopher://host/0/2023/notes.txt", gopher.FILE, true},
+		{"gopher://host/1/phlog", "gopher://host/1/phlog", 0, false},
+		{"gopher://host/0/notes.txt", "gopher://host/0/notes.txt", 0, false},
+		{"gopher://host/1", "gopher://host/1", 0, false},
+	}
+	for _, test := range tests {
+		got, item_type, added := gopherAddItemType(test.url)
+		if got != test.want || item_type != test.want_type || added != test.added {
+			t.Errorf("gopherAddItemType(%q) = %q, %q, %v, want %q, %q, %v", test.url,
+				got, item_type, added, test.want, test.want_type, test.added)
+		}
+	}
+}
+
+// Urls without an item type are fetched with the type they most likely have
+func TestFetchWithoutItemType(t *testing.T) {
+	address := testGopherServer(t)
+	for _, _url := range []string{"gopher://" + address, "gopher://" + address + "/"} {
+		page, err := Fetch(DefaultConfig(), _url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Type != GopherDirectory || len(page.Links) != 1 {
+			t.Errorf("%s: got %v with %d links, want the directory", _url, page.Type, len(page.Links))
+		}
+	}
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Type != TextType || page.Content != testText {
+		t.Errorf("got %v %q, want the text file", page.Type, page.Content)
+	}
+}
+
+// Directories keep the bytes they were parsed from, to show them raw
+func TestFetchGopherDirectoryRaw(t *testing.T) {
+	address := testGopherServer(t)
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(address)
+	want := "iWelcome to the test server\tfake\t(NULL)\t0\r\n" +
+		fmt.Sprintf("0Hello text\t/hello.txt\t%s\t%s\r\n", host, port) + ".\r\n"
+	if string(page.Raw) != want {
+		t.Errorf("Raw = %q, want %q", page.Raw, want)
+	}
+}
+
+// Images whose header says they are too big are downloaded without being
+// decoded
+func TestFetchGopherImageSize(t *testing.T) {
+	var small bytes.Buffer
+	if err := gif.Encode(&small, image.NewPaletted(image.Rect(0, 0, 2, 2), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The logical screen size follows the 6 byte signature
+	huge := append([]byte(nil), small.Bytes()...)
+	binary.LittleEndian.PutUint16(huge[6:], 0xffff)
+	binary.LittleEndian.PutUint16(huge[8:], 0xffff)
+	address := serveGopher(t, func(address string, selector string) string {
+		if selector == "/huge.gif" {
+			return string(huge)
+		}
+		return small.String()
+	})
+	config := DefaultConfig()
+	config.InlineImages = true
+	config.DownloadDir = t.TempDir()
+	config.Downloads = NewDownloads()
+
+	page, err := Fetch(config, "gopher://"+address+"/g/small.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page == nil || page.Image == nil || page.Image.Bounds().Dx() != 2 {
+		t.Errorf("small image not shown inline: %+v", page)
+	}
+
+	page, err = Fetch(config, "gopher://"+address+"/g/huge.gif")
+	if err != nil || page != nil {
+		t.Fatalf("got %+v, %v, want the image downloaded", page, err)
+	}
+	config.Downloads.WaitDownloads()
+	saved, err := ioutil.ReadFile(filepath.Join(config.DownloadDir, "huge.gif"))
+	if err != nil || !bytes.Equal(saved, huge) {
+		t.Errorf("downloaded %d bytes (%v), want %d", len(saved), err, len(huge))
+	}
+}
+
+// Items are paired with their links by line, with links found in info
+// lines left out along with the info lines
+func TestGopherDirectoryItems(t *testing.T) {
+	address := serveGopher(t, func(address string, selector string) string {
+		return "iSee gopher://example.org/ and gemini://example.org/\t\tnull.host\t1\r\n" +
+			"0First\t/first.txt\texample.org\t70\r\n" +
+			"iJust text\t\tnull.host\t1\r\n" +
+			"1Second\t/second\texample.org\t70\r\n" +
+			".\r\n"
+	})
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Urls in info lines are made into links when the page is rendered
+	if len(page.Links) != 2 {
+		t.Fatalf("got %d links, want 2", len(page.Links))
+	}
+	page.Links = append([]*Link{InfoLink("gopher://example.org/"), InfoLink("gemini://example.org/")}, page.Links...)
+	page.LinkLines = append([]int{0, 0}, page.LinkLines...)
+	items := GopherDirectoryItems(page)
+	if len(items) != 2 {
+		t.Fatalf("got %d items, want 2", len(items))
+	}
+	for i, want := range []string{"gopher://example.org/0/first.txt", "gopher://example.org/1/second"} {
+		if len(items[i].Links) != 1 || items[i].Links[0].Url != want {
+			t.Errorf("item %d has links %v, want %s", i, items[i].Links, want)
+		}
+	}
+	// A page of just the second item has its link on the first line
+	filtered := GopherDirectoryPage(page, "filtered", items[1:])
+	again := GopherDirectoryItems(filtered)
+	if len(again) != 1 || again[0].Links[0].Url != "gopher://example.org/1/second" {
+		t.Errorf("filtered page has items %+v", again)
+	}
+}
+
+func TestGopherItemToUrl(t *testing.T) {
+	tests := []struct {
+		item gopher.Item
+		want string
+	}{
+		{gopher.Item{Type: gopher.FILE, Selector: "/notes.txt", Host: "host", Port: 70}, "gopher://host/0/notes.txt"},
+		{gopher.Item{Type: gopher.FILE, Selector: "/notes.txt", Host: "host", Port: 7070}, "gopher://host:7070/0/notes.txt"},
+		{gopher.Item{Type: gopher.DIRECTORY, Selector: "", Host: "host", Port: 70}, "gopher://host/1"},
+		{gopher.Item{Type: gopher.DIRECTORY, Selector: "", Host: "host", Port: 0}, "gopher://host/1"},
+		{gopher.Item{Type: gopher.DIRECTORY, Selector: "", Host: "host", Port: 7070}, "gopher://host:7070/1"},
+		// A tab is sent as is, separating the selector from a search term
+		{gopher.Item{Type: gopher.INDEXSEARCH, Selector: "/search\tterm", Host: "host", Port: 70}, "gopher://host/7/search%09term"},
+		{gopher.Item{Type: gopher.HTML, Selector: "URL:https://example.com/", Host: "host", Port: 70}, "https://example.com/"},
+	}
+	for _, test := range tests {
+		if got := gopherItemToUrl(&test.item); got != test.want {
+			t.Errorf("gopherItemToUrl(%+v) = %q, want %q", test.item, got, test.want)
+		}
+	}
+}
+
+// Serve the start of a text file on a local port, then end the connection
+// with end instead of closing it normally
+func servePartialText(t *testing.T, text string, end func(conn *net.TCPConn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+			conn.Write([]byte(text))
+			end(conn.(*net.TCPConn))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// What arrived of a text file before the connection broke is shown, marked
+// as cut off
+func TestFetchGopherTextTruncated(t *testing.T) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	tests := []struct {
+		name string
+		end  func(conn *net.TCPConn)
+	}{
+		{"server stops sending", func(conn *net.TCPConn) { <-done }},
+		{"connection reset", func(conn *net.TCPConn) {
+			// Let the text be read before the reset
+			time.Sleep(100 * time.Millisecond)
+			conn.SetLinger(0)
+		}},
+	}
+	for _, test := range tests {
+		address := servePartialText(t, "First line\nSecond li", test.end)
+		config := DefaultConfig()
+		config.Timeout = 1
+		page, err := Fetch(config, "gopher://"+address+"/0/file.txt")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want := "First line\nSecond li\n" + TRUNCATED_MARKER + "\n"
+		if page.Content != want {
+			t.Errorf("%s: got %q, want %q", test.name, page.Content, want)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		text    string
+		charset string
+		want    string
+	}{
+		// Box drawing and shading used by ANSI art
+		{"\xc9\xcd\xbb \xb0\xb1\xb2", "cp437", "╔═╗ ░▒▓"},
+		{"\xc9\xcd\xbb \xb0\xb1\xb2", "IBM437", "╔═╗ ░▒▓"},
+		{"caf\xe9", "", "café"},
+		{"café", "auto", "café"},
+		{"caf\xe9", "no-such-charset", "caf\xe9"},
+	}
+	for _, test := range tests {
+		if got := decodeText([]byte(test.text), test.charset); got != test.want {
+			t.Errorf("decodeText(%q, %q) = %q, want %q", test.text, test.charset, got, test.want)
+		}
+	}
+}
+
+// Text files over MaxContentSize are downloaded instead of shown, and
+// directories are cut off at it
+func TestMaxContentSize(t *testing.T) {
+	text := strings.Repeat("A line of text\n", 10)
+	var directory strings.Builder
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&directory, "iInfo line %d\tfake\t(NULL)\t0\r\n", i)
+	}
+	directory.WriteString(".\r\n")
+	address := serveGopher(t, func(address string, selector string) string {
+		if selector == "/big.txt" {
+			return text
+		}
+		return directory.String()
+	})
+	config := DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	config.Downloads = NewDownloads()
+	config.MaxContentSize = 100
+
+	page, err := Fetch(config, "gopher://"+address+"/0/big.txt")
+	if err != nil || page != nil {
+		t.Fatalf("got %+v, %v, want the file downloaded", page, err)
+	}
+	config.Downloads.WaitDownloads()
+	saved, err := ioutil.ReadFile(filepath.Join(config.DownloadDir, "big.txt"))
+	if err != nil || string(saved) != text {
+		t.Errorf("saved %q (%v), want all of the file", saved, err)
+	}
+
+	page, err = Fetch(config, "gopher://"+address+"/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n_items := strings.Count(page.Content, "Info line")
+	if n_items == 0 || n_items >= 10 || !strings.Contains(page.Content, TOO_LARGE_MARKER) {
+		t.Errorf("got %q, want the first few items and %q", page.Content, TOO_LARGE_MARKER)
+	}
+}
+
+// The search url asks for the link's selector with the search term, however
+// short the selector and whatever is in the term
+func TestGopherQueryUrl(t *testing.T) {
+	tests := []struct {
+		link_url string
+		selector string
+	}{
+		{"gopher://host/7", ""},
+		{"gopher://host/7/", "/"},
+		{"gopher://host/7/search", "/search"},
+		{"gopher://host:7070/7/search", "/search"},
+		{"gopher://host/7/search%09old%20term", "/search"},
+	}
+	terms := []string{"word", "two words", "a&b=c?d#e%f/g", "日本語", "tab\there"}
+	for _, test := range tests {
+		for _, term := range terms {
+			query_url, err := GopherQueryUrl(&Link{Url: test.link_url}, term)
+			if err != nil {
+				t.Errorf("GopherQueryUrl(%q, %q): %v", test.link_url, term, err)
+				continue
+			}
+			parsed_url, err := url.Parse(query_url)
+			if err != nil {
+				t.Errorf("GopherQueryUrl(%q, %q) = %q: %v", test.link_url, term, query_url, err)
+				continue
+			}
+			item_type, selector, search_term := SplitGopherUrl(parsed_url)
+			if item_type != gopher.DIRECTORY || selector != test.selector || search_term != term {
+				t.Errorf("GopherQueryUrl(%q, %q) = %q, which asks for %c %q %q", test.link_url, term,
+					query_url, item_type, selector, search_term)
+			}
+		}
+	}
+	if got, _ := GopherQueryUrl(&Link{Url: "gopher://host/7"}, "two words"); got != "gopher://host/1%09two%20words" {
+		t.Errorf("got %q, want gopher://host/1%%09two%%20words", got)
+	}
+	if _, err := GopherQueryUrl(&Link{Url: "gopher://host/7/search"}, "  "); err == nil {
+		t.Error("blank search term accepted")
+	}
+}
+
+// Selectors come back out of the urls made for them, and urls typed with
+// spaces or a bare % still ask for the selector meant
+func TestGopherUrlRoundTrip(t *testing.T) {
+	selectors := []string{
+		"/my file.txt",
+		"/phlog/2023 notes/entry one.txt",
+		"/café/日本語.txt",
+		"/100%.txt",
+		"/a+b=c&d.txt",
+	}
+	for _, selector := range selectors {
+		item := &gopher.Item{Type: gopher.FILE, Selector: selector, Host: "host", Port: 70}
+		item_url := gopherItemToUrl(item)
+		parsed_url, err := parseUrl(item_url)
+		if err != nil {
+			t.Errorf("%q: can't parse %q: %v", selector, item_url, err)
+			continue
+		}
+		item_type, got, _ := SplitGopherUrl(parsed_url)
+		if item_type != gopher.FILE || got != selector {
+			t.Errorf("%q: %q asks for %c %q", selector, item_url, item_type, got)
+		}
+	}
+
+	typed := []struct {
+		url      string
+		selector string
+	}{
+		{"gopher://host/0/my file.txt", "/my file.txt"},
+		{"gopher://host/0/café/日本語.txt", "/café/日本語.txt"},
+		{"gopher://host/0/100%.txt", "/100%.txt"},
+		{"gopher://host/0/50% off sale.txt", "/50% off sale.txt"},
+	}
+	for _, test := range typed {
+		parsed_url, err := parseUrl(test.url)
+		if err != nil {
+			t.Errorf("parseUrl(%q): %v", test.url, err)
+			continue
+		}
+		if _, got, _ := SplitGopherUrl(parsed_url); got != test.selector {
+			t.Errorf("parseUrl(%q) asks for %q, want %q", test.url, got, test.selector)
+		}
+	}
+}
+
+func TestGopherItemToUrlIPv6(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"::1", 70, "gopher://[::1]/1/dir"},
+		{"::1", 7070, "gopher://[::1]:7070/1/dir"},
+		{"[2001:db8::1]", 70, "gopher://[2001:db8::1]/1/dir"},
+		{"[2001:db8::1]", 7070, "gopher://[2001:db8::1]:7070/1/dir"},
+	}
+	for _, test := range tests {
+		item := &gopher.Item{Type: gopher.DIRECTORY, Selector: "/dir", Host: test.host, Port: test.port}
+		if got := gopherItemToUrl(item); got != test.want {
+			t.Errorf("host %s port %d: got %q, want %q", test.host, test.port, got, test.want)
+		}
+	}
+}
+
+func TestSplitJoinGopherUrl(t *testing.T) {
+	tests := []struct {
+		item_type   gopher.ItemType
+		selector    string
+		search_term string
+	}{
+		{gopher.DIRECTORY, "/phlog", ""},
+		{gopher.INDEXSEARCH, "/search", "several words to find"},
+		{gopher.DIRECTORY, "/search", "a&b=c?d#e%f/g+h"},
+		{gopher.DIRECTORY, "/cgi bin/search", "日本語 テキスト"},
+		{gopher.DIRECTORY, "", "no selector"},
+	}
+	for _, test := range tests {
+		joined := JoinGopherUrl("gophers", "host:7070", test.item_type, test.selector, test.search_term)
+		parsed_url, err := url.Parse(joined)
+		if err != nil {
+			t.Errorf("can't parse %q: %v", joined, err)
+			continue
+		}
+		item_type, selector, search_term := SplitGopherUrl(parsed_url)
+		if item_type != test.item_type || selector != test.selector || search_term != test.search_term ||
+			parsed_url.Scheme != "gophers" || parsed_url.Host != "host:7070" {
+			t.Errorf("%q split into %c %q %q, want %c %q %q", joined, item_type, selector, search_term,
+				test.item_type, test.selector, test.search_term)
+		}
+	}
+
+	// Search terms can also be given as the query string
+	parsed_url, _ := url.Parse("gopher://host/7/search?two%20words")
+	if item_type, selector, search_term := SplitGopherUrl(parsed_url); item_type != gopher.INDEXSEARCH ||
+		selector != "/search" || search_term != "two words" {
+		t.Errorf("query string split into %c %q %q", item_type, selector, search_term)
+	}
+}
+
+func gzipText(t *testing.T, text string) string {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return compressed.String()
+}
+
+// Gzipped text files are shown decompressed, unless they decompress to more
+// than MaxContentSize, when the compressed file is downloaded as it is
+func TestFetchGzippedText(t *testing.T) {
+	small := gzipText(t, testText)
+	bomb := gzipText(t, strings.Repeat("\x00", 10<<20))
+	address := serveGopher(t, func(address string, selector string) string {
+		if selector == "/bomb.gz" {
+			return bomb
+		}
+		return small
+	})
+	config := DefaultConfig()
+	config.Decompress = true
+	config.DownloadDir = t.TempDir()
+	config.Downloads = NewDownloads()
+	config.MaxContentSize = 64 << 10
+
+	page, err := Fetch(config, "gopher://"+address+"/0/hello.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Content != testText {
+		t.Errorf("got %q, want %q", page.Content, testText)
+	}
+
+	page, err = Fetch(config, "gopher://"+address+"/0/bomb.gz")
+	if err != nil || page != nil {
+		t.Fatalf("got %+v, %v, want the file downloaded", page, err)
+	}
+	config.Downloads.WaitDownloads()
+	saved, err := ioutil.ReadFile(filepath.Join(config.DownloadDir, "bomb.gz"))
+	if err != nil || string(saved) != bomb {
+		t.Errorf("saved %d bytes (%v), want the %d compressed bytes", len(saved), err, len(bomb))
+	}
+}
+
+// Empty directories and files load as empty pages rather than failing
+func TestFetchEmpty(t *testing.T) {
+	address := serveGopher(t, func(address string, selector string) string {
+		if selector == "/dir" {
+			return ".\r\n"
+		}
+		return ""
+	})
+	page, err := Fetch(DefaultConfig(), "gopher://"+address+"/1/dir")
+	if err != nil || page.Type != GopherDirectory || len(page.Links) != 0 || strings.TrimSpace(page.Content) != "" {
+		t.Errorf("empty directory: got %+v, %v", page, err)
+	}
+	page, err = Fetch(DefaultConfig(), "gopher://"+address+"/0/empty.txt")
+	if err != nil || page.Type != TextType || page.Content != "" {
+		t.Errorf("empty file: got %+v, %v", page, err)
+	}
+}
@@ -0,0 +1,83 @@
+// Package core fetches pages over gopher, gemini and the other protocols
+// viscacha supports, independent of the interface that shows them.
+package core
+
+import (
+	"image"
+
+	"git.mills.io/prologic/go-gopher"
+)
+
+type ContentType int
+
+const (
+	TextType = iota
+	GopherDirectory
+	GopherQuery
+	ImageType
+	BinaryType
+	HTMLType
+	GemtextType
+	AudioType
+	UnknownType
+)
+
+// Short label for the content type, shown in the status line
+func (content_type ContentType) String() string {
+	switch content_type {
+	case TextType:
+		return "TXT"
+	case GopherDirectory:
+		return "DIR"
+	case GopherQuery:
+		return "QRY"
+	case ImageType:
+		return "IMG"
+	case BinaryType:
+		return "BIN"
+	case HTMLType:
+		return "HTM"
+	case GemtextType:
+		return "GMI"
+	case AudioType:
+		return "AUD"
+	default:
+		return "???"
+	}
+}
+
+var Gopher_to_content_type = map[gopher.ItemType]ContentType{
+	gopher.FILE:        TextType,
+	gopher.DIRECTORY:   GopherDirectory,
+	gopher.INDEXSEARCH: GopherQuery,
+	gopher.GIF:         ImageType,
+	gopher.IMAGE:       ImageType,
+	gopher.PNG:         ImageType,
+	gopher.DOSARCHIVE:  BinaryType,
+	gopher.BINARY:      BinaryType,
+	gopher.AUDIO:       AudioType,
+	gopher.DOC:         BinaryType,
+	gopher.BINHEX:      BinaryType,
+	gopher.HTML:        HTMLType,
+}
+
+type Link struct {
+	Type        ContentType
+	Url         string
+	Description string          // Text shown for the link, if it has any
+	ItemType    gopher.ItemType // Item type of gopher links, 0 for other links
+}
+
+type Page struct {
+	Type         ContentType
+	Url          string
+	Title        string
+	Content      string
+	Raw          []byte // The content as received, before it was parsed or decoded
+	Links        []*Link
+	LinkLines    []int // The line each link is rendered on, set by the renderer and for directories by handlers
+	ScrollOffset int
+	Parent       *Page
+	LinkIndex    int
+	Image        image.Image // Decoded image, for ImageType pages shown inline
+}
@@ -5,7 +5,9 @@ go 1.15
 require (
 	git.mills.io/prologic/go-gopher v0.0.0-20210723054659-c5e856b800b8
 	github.com/adrg/xdg v0.4.0 // indirect
+	github.com/atotto/clipboard v0.1.4
 	github.com/gdamore/tcell/v2 v2.0.1-0.20201017141208-acf90d56d591
-	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7 // indirect
+	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/rivo/tview v0.0.0-20210125085121-dbc1f32bb1d0
+	golang.org/x/text v0.3.5
 )
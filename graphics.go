@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Terminals that understand sixel or kitty graphics get images drawn with
+// them, on top of blank lines the page leaves for the image. tcell doesn't
+// know about graphics, so they are written to the terminal once tcell has
+// drawn everything else.
+
+// Ways of drawing images, chosen with the image_protocol setting
+const (
+	IMAGE_PROTOCOL_AUTO   = "auto"   // Detect what the terminal supports
+	IMAGE_PROTOCOL_KITTY  = "kitty"  // Kitty graphics protocol
+	IMAGE_PROTOCOL_SIXEL  = "sixel"  // Sixel graphics
+	IMAGE_PROTOCOL_BLOCKS = "blocks" // Colored half block characters, works everywhere
+	IMAGE_PROTOCOL_NONE   = "none"   // Images are downloaded rather than shown
+)
+
+// Size of a character cell in pixels when the terminal doesn't say
+const DEFAULT_CELL_WIDTH = 10
+const DEFAULT_CELL_HEIGHT = 20
+
+// Kitty wants the image data sent in chunks of at most this many bytes
+const KITTY_CHUNK_SIZE = 4096
+
+// The size of a character cell in pixels, or 0, 0 if the terminal doesn't
+// report it. Replaced in tests.
+var cellSize = terminalCellSize
+
+// Guess which graphics protocol the terminal speaks from the variables the
+// terminals known to support one set. Terminals can't be asked directly
+// while tcell is reading their replies as key presses. Inside tmux or
+// screen the escapes would have to be wrapped for the terminal outside, so
+// images are downloaded there, like in terminals that aren't known.
+func detectImageProtocol(getenv func(string) string) string {
+	term := getenv("TERM")
+	term_program := getenv("TERM_PROGRAM")
+	if getenv("TMUX") != "" || strings.HasPrefix(term, "screen") || strings.HasPrefix(term, "tmux") {
+		return IMAGE_PROTOCOL_NONE
+	}
+	switch {
+	case getenv("KITTY_WINDOW_ID") != "" || term == "xterm-kitty" ||
+		term == "xterm-ghostty" || term_program == "ghostty":
+		return IMAGE_PROTOCOL_KITTY
+	case term_program == "WezTerm" || term_program == "mintty" || term == "contour" ||
+		strings.HasPrefix(term, "foot") || strings.HasPrefix(term, "mlterm") ||
+		strings.Contains(term, "sixel"):
+		return IMAGE_PROTOCOL_SIXEL
+	}
+	return IMAGE_PROTOCOL_NONE
+}
+
+// The protocol to draw images with for the image_protocol setting
+func resolveImageProtocol(setting string) string {
+	if setting == "" || setting == IMAGE_PROTOCOL_AUTO {
+		return detectImageProtocol(os.Getenv)
+	}
+	return setting
+}
+
+// An image drawn with terminal graphics over blank lines of the page
+type inlineImage struct {
+	img      image.Image
+	protocol string
+	columns  int // Size of the image in character cells
+	rows     int
+	id       int // Kitty's id for the image once it has been sent
+	// Size in pixels of the image sent to kitty, scaled to its cells
+	sent_width  int
+	sent_height int
+}
+
+// The part of an inline image that is on screen, and where
+type imagePlacement struct {
+	image     *inlineImage
+	x, y      int // Screen cell of the top left of the visible part
+	first_row int // First row of the image that is visible
+	rows      int // Rows of the image that are visible
+}
+
+// Lay page.Image out as an inline image drawn with protocol, width columns
+// wide at most. Returns nil if the terminal's cell size is needed and unknown.
+func newInlineImage(img image.Image, protocol string, width int) *inlineImage {
+	cell_width, cell_height := cellSize()
+	if cell_width <= 0 || cell_height <= 0 {
+		// Sixel images are sized in pixels, so they can't be fit to the
+		// reserved lines without knowing how big those are
+		if protocol == IMAGE_PROTOCOL_SIXEL {
+			return nil
+		}
+		cell_width, cell_height = DEFAULT_CELL_WIDTH, DEFAULT_CELL_HEIGHT
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() <= 0 || bounds.Dy() <= 0 {
+		return nil
+	}
+	columns := (bounds.Dx() + cell_width - 1) / cell_width
+	if columns > width {
+		columns = width
+	}
+	pixel_height := bounds.Dy() * columns * cell_width / bounds.Dx()
+	rows := (pixel_height + cell_height - 1) / cell_height
+	if rows < 1 {
+		rows = 1
+	}
+	return &inlineImage{img: img, protocol: protocol, columns: columns, rows: rows}
+}
+
+// Where the rows of the image starting scroll_row rows into the page show
+// up in a view at x, y that is height rows high. The image is at the top of
+// the page. Returns nil if none of it is in view.
+func (inline *inlineImage) place(x int, y int, height int, scroll_row int) *imagePlacement {
+	rows := inline.rows - scroll_row
+	if rows > height {
+		rows = height
+	}
+	if scroll_row < 0 || rows <= 0 {
+		return nil
+	}
+	return &imagePlacement{image: inline, x: x, y: y, first_row: scroll_row, rows: rows}
+}
+
+// Draw the inline image of the page being shown, if there is one, with
+// terminal graphics written to out. Called after tview has drawn the screen.
+func (pageview *PageView) DrawGraphics(screen tcell.Screen, out io.Writer) {
+	var placement *imagePlacement
+	if pageview.textDrawn && pageview.inlineImage != nil {
+		x, y, _, height := pageview.PageText.GetInnerRect()
+		row, _ := pageview.PageText.GetScrollOffset()
+		placement = pageview.inlineImage.place(x, y, height, row)
+	}
+	pageview.textDrawn = false
+	// A new screen, like after running the pager, starts out without graphics
+	if screen != pageview.graphicsScreen {
+		pageview.graphicsScreen = screen
+		pageview.placement = nil
+	}
+	last := pageview.placement
+	if placement == last || (placement != nil && last != nil && *placement == *last) {
+		return
+	}
+	pageview.placement = placement
+	// tcell thinks the cells under a sixel image are still blank, so it
+	// only draws over it when told to draw everything again
+	if last != nil && last.image.protocol == IMAGE_PROTOCOL_SIXEL {
+		screen.Sync()
+	}
+	if last != nil && last.image.protocol == IMAGE_PROTOCOL_KITTY && (placement == nil || last.image != placement.image) {
+		// Frees the image data as well as taking it off the screen
+		fmt.Fprintf(out, "\x1b_Ga=d,d=I,i=%d,q=2\x1b\\", last.image.id)
+	}
+	if placement == nil {
+		return
+	}
+	// tcell has finished writing to the terminal, and doesn't expect the
+	// graphics to move the cursor
+	screen.Show()
+	var graphics bytes.Buffer
+	fmt.Fprintf(&graphics, "\x1b7\x1b[%d;%dH", placement.y+1, placement.x+1)
+	switch placement.image.protocol {
+	case IMAGE_PROTOCOL_KITTY:
+		writeKittyPlacement(&graphics, placement)
+	case IMAGE_PROTOCOL_SIXEL:
+		writeSixelPlacement(&graphics, placement)
+	}
+	graphics.WriteString("\x1b8")
+	out.Write(graphics.Bytes())
+}
+
+var lastKittyImageId = 0
+
+// Show the visible rows of a placement with the kitty graphics protocol.
+// The image is sent once, then the part of it in view is placed again as
+// the page scrolls. Kitty scales it to fit the cells it is given.
+func writeKittyPlacement(out io.Writer, placement *imagePlacement) {
+	inline := placement.image
+	if inline.id == 0 {
+		lastKittyImageId++
+		inline.id = lastKittyImageId
+		cell_width, cell_height := cellSize()
+		if cell_width <= 0 || cell_height <= 0 {
+			cell_width, cell_height = DEFAULT_CELL_WIDTH, DEFAULT_CELL_HEIGHT
+		}
+		// No need to send more pixels than the cells can show
+		inline.sent_width, inline.sent_height = inline.columns*cell_width, inline.rows*cell_height
+		scaled := scaleImage(inline.img, inline.sent_width, inline.sent_height)
+		var encoded bytes.Buffer
+		png.Encode(&encoded, scaled)
+		data := base64.StdEncoding.EncodeToString(encoded.Bytes())
+		for start := 0; start < len(data); start += KITTY_CHUNK_SIZE {
+			end := start + KITTY_CHUNK_SIZE
+			more := 1
+			if end >= len(data) {
+				end, more = len(data), 0
+			}
+			if start == 0 {
+				fmt.Fprintf(out, "\x1b_Ga=t,f=100,i=%d,q=2,m=%d;%s\x1b\\", inline.id, more, data[start:end])
+			} else {
+				fmt.Fprintf(out, "\x1b_Gm=%d;%s\x1b\\", more, data[start:end])
+			}
+		}
+	}
+	// Placing it again replaces the last placement, which has id 1
+	source_y := placement.first_row * inline.sent_height / inline.rows
+	source_height := placement.rows * inline.sent_height / inline.rows
+	fmt.Fprintf(out, "\x1b_Ga=p,i=%d,p=1,x=0,y=%d,w=%d,h=%d,c=%d,r=%d,C=1,q=2\x1b\\",
+		inline.id, source_y, inline.sent_width, source_height, inline.columns, placement.rows)
+}
+
+// Show the visible rows of a placement as a sixel image, cut to whole bands
+// of six pixels so the terminal doesn't scroll past the bottom of the view
+func writeSixelPlacement(out io.Writer, placement *imagePlacement) {
+	inline := placement.image
+	cell_width, cell_height := cellSize()
+	width := inline.columns * cell_width
+	scaled := scaleImage(inline.img, width, inline.rows*cell_height)
+	top := placement.first_row * cell_height
+	height := placement.rows * cell_height / 6 * 6
+	visible := scaled.SubImage(image.Rect(0, top, width, top+height)).(*image.RGBA)
+	encodeSixel(out, visible)
+}
+
+// Scale img to width by height pixels, picking the nearest pixel
+func scaleImage(img image.Image, width int, height int) *image.RGBA {
+	bounds := img.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		source_y := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			source_x := bounds.Min.X + x*bounds.Dx()/width
+			scaled.Set(x, y, img.At(source_x, source_y))
+		}
+	}
+	return scaled
+}
+
+// Write img as sixel graphics, with its colors reduced to a palette of 256.
+// Each band of six rows of pixels is written one color at a time, every
+// column a character whose bits say which of the six pixels have the color.
+func encodeSixel(out io.Writer, img image.Image) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	paletted := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, bounds.Min)
+
+	var sixel bytes.Buffer
+	// Pixels with no color set are left as they were, and pixels are square
+	fmt.Fprintf(&sixel, "\x1bP0;1q\"1;1;%d;%d", width, height)
+	for i, color := range paletted.Palette {
+		r, g, b, _ := color.RGBA()
+		fmt.Fprintf(&sixel, "#%d;2;%d;%d;%d", i, r*100/0xffff, g*100/0xffff, b*100/0xffff)
+	}
+	bits := make([]byte, width)
+	for band := 0; band < height; band += 6 {
+		var used [256]bool
+		for y := band; y < band+6 && y < height; y++ {
+			for x := 0; x < width; x++ {
+				used[paletted.ColorIndexAt(x, y)] = true
+			}
+		}
+		for index, is_used := range used {
+			if !is_used {
+				continue
+			}
+			for x := 0; x < width; x++ {
+				bits[x] = 0
+				for row := 0; row < 6 && band+row < height; row++ {
+					if int(paletted.ColorIndexAt(x, band+row)) == index {
+						bits[x] |= 1 << row
+					}
+				}
+			}
+			fmt.Fprintf(&sixel, "#%d", index)
+			writeSixelRuns(&sixel, bits)
+			// Back to the start of the band for the next color
+			sixel.WriteByte('$')
+		}
+		sixel.WriteByte('-')
+	}
+	sixel.WriteString("\x1b\\")
+	out.Write(sixel.Bytes())
+}
+
+// Write the sixel characters for bits, with runs of the same one shortened
+// to "!<count><character>"
+func writeSixelRuns(sixel *bytes.Buffer, bits []byte) {
+	for start := 0; start < len(bits); {
+		end := start + 1
+		for end < len(bits) && bits[end] == bits[start] {
+			end++
+		}
+		character := 63 + bits[start]
+		if run := end - start; run > 3 {
+			fmt.Fprintf(sixel, "!%d%c", run, character)
+		} else {
+			sixel.Write(bytes.Repeat([]byte{character}, run))
+		}
+		start = end
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/ottopasuuna/viscacha/core"
+)
+
+func TestDetectImageProtocol(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"TERM": "xterm-kitty"}, IMAGE_PROTOCOL_KITTY},
+		{map[string]string{"TERM": "xterm-256color", "KITTY_WINDOW_ID": "1"}, IMAGE_PROTOCOL_KITTY},
+		{map[string]string{"TERM": "foot"}, IMAGE_PROTOCOL_SIXEL},
+		{map[string]string{"TERM": "xterm-256color", "TERM_PROGRAM": "WezTerm"}, IMAGE_PROTOCOL_SIXEL},
+		{map[string]string{"TERM": "xterm-256color"}, IMAGE_PROTOCOL_NONE},
+		{map[string]string{"TERM": "xterm-kitty", "TMUX": "/tmp/tmux-1000/default,1,0"}, IMAGE_PROTOCOL_NONE},
+		{map[string]string{"TERM": "screen-256color"}, IMAGE_PROTOCOL_NONE},
+		{map[string]string{}, IMAGE_PROTOCOL_NONE},
+	}
+	for _, test := range tests {
+		getenv := func(name string) string { return test.env[name] }
+		if got := detectImageProtocol(getenv); got != test.want {
+			t.Errorf("detectImageProtocol(%v) = %s, want %s", test.env, got, test.want)
+		}
+	}
+}
+
+// Images are only fetched to be shown when there is a way to draw them
+func TestFetchConfigInlineImages(t *testing.T) {
+	client := newTestClient("gopher://example.com/")
+	client.config.InlineImages = true
+	for protocol, want := range map[string]bool{
+		IMAGE_PROTOCOL_KITTY:  true,
+		IMAGE_PROTOCOL_SIXEL:  true,
+		IMAGE_PROTOCOL_BLOCKS: true,
+		IMAGE_PROTOCOL_NONE:   false,
+	} {
+		client.PageView.ImageProtocol = protocol
+		if got := client.fetchConfig().InlineImages; got != want {
+			t.Errorf("InlineImages with %s images = %v, want %v", protocol, got, want)
+		}
+	}
+}
+
+// Pretend the terminal has cells width by height pixels for the test
+func setCellSize(t *testing.T, width int, height int) {
+	cellSize = func() (int, int) { return width, height }
+	t.Cleanup(func() { cellSize = terminalCellSize })
+}
+
+func TestNewInlineImage(t *testing.T) {
+	setCellSize(t, 10, 20)
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	inline := newInlineImage(img, IMAGE_PROTOCOL_SIXEL, 80)
+	if inline.columns != 20 || inline.rows != 5 {
+		t.Errorf("200x100 image takes %dx%d cells, want 20x5", inline.columns, inline.rows)
+	}
+	// Scaled down to the width of the view
+	inline = newInlineImage(img, IMAGE_PROTOCOL_SIXEL, 10)
+	if inline.columns != 10 || inline.rows != 3 {
+		t.Errorf("200x100 image in 10 columns takes %dx%d cells, want 10x3", inline.columns, inline.rows)
+	}
+
+	setCellSize(t, 0, 0)
+	if inline := newInlineImage(img, IMAGE_PROTOCOL_SIXEL, 80); inline != nil {
+		t.Error("sixel image laid out without knowing the cell size")
+	}
+	if inline := newInlineImage(img, IMAGE_PROTOCOL_KITTY, 80); inline == nil {
+		t.Error("kitty image not laid out without knowing the cell size")
+	}
+}
+
+func TestInlineImagePlace(t *testing.T) {
+	inline := &inlineImage{columns: 10, rows: 8}
+	tests := []struct {
+		height, scroll_row int
+		want               *imagePlacement
+	}{
+		{20, 0, &imagePlacement{image: inline, x: 2, y: 1, first_row: 0, rows: 8}},
+		{5, 0, &imagePlacement{image: inline, x: 2, y: 1, first_row: 0, rows: 5}},
+		{20, 6, &imagePlacement{image: inline, x: 2, y: 1, first_row: 6, rows: 2}},
+		{20, 8, nil},
+	}
+	for _, test := range tests {
+		got := inline.place(2, 1, test.height, test.scroll_row)
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("place(height %d, row %d) = %+v, want %+v", test.height, test.scroll_row, got, test.want)
+		}
+	}
+}
+
+func TestEncodeSixel(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 5, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 5; x++ {
+			img.Set(x, y, color.RGBA{0xff, 0, 0, 0xff})
+		}
+	}
+	var out bytes.Buffer
+	encodeSixel(&out, img)
+	sixel := out.String()
+	if !strings.HasPrefix(sixel, "\x1bP0;1q\"1;1;5;6") || !strings.HasSuffix(sixel, "\x1b\\") {
+		t.Fatalf("not a sixel image: %q", sixel)
+	}
+	// One band of one color, all six pixels of all five columns set
+	if !strings.Contains(sixel, "!5~$-") {
+		t.Errorf("band not written as a run of five full columns: %q", sixel)
+	}
+}
+
+// Graphics are only written again when the image moves on the screen
+func TestDrawGraphics(t *testing.T) {
+	setCellSize(t, 10, 20)
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Fini()
+	screen.SetSize(80, 24)
+	pageView := NewPageView()
+	pageView.ImageProtocol = IMAGE_PROTOCOL_KITTY
+	pageView.PageText.SetRect(0, 0, 80, 20)
+	pageView.RenderPage(&core.Page{Type: core.ImageType, Image: image.NewRGBA(image.Rect(0, 0, 100, 100))})
+
+	var out bytes.Buffer
+	pageView.PageText.Draw(screen)
+	pageView.DrawGraphics(screen, &out)
+	if !strings.Contains(out.String(), "\x1b_Ga=t,f=100") || !strings.Contains(out.String(), "\x1b_Ga=p,") {
+		t.Fatalf("image not sent and placed: %q", out.String())
+	}
+	out.Reset()
+	pageView.PageText.Draw(screen)
+	pageView.DrawGraphics(screen, &out)
+	if out.Len() != 0 {
+		t.Errorf("unmoved image drawn again: %q", out.String())
+	}
+	// Leaving the page takes the image off the screen
+	pageView.RenderPage(&core.Page{Type: core.TextType, Content: "text\n"})
+	pageView.PageText.Draw(screen)
+	pageView.DrawGraphics(screen, &out)
+	if !strings.Contains(out.String(), "\x1b_Ga=d,d=I") {
+		t.Errorf("image not deleted: %q", out.String())
+	}
+}
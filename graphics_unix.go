@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Ask the terminal on stdout for its size in pixels, and divide it by its
+// size in cells. Not every terminal fills the pixel size in.
+func terminalCellSize() (int, int) {
+	var size struct {
+		rows, columns, pixel_width, pixel_height uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ,
+		uintptr(unsafe.Pointer(&size)))
+	if errno != 0 || size.rows == 0 || size.columns == 0 {
+		return 0, 0
+	}
+	return int(size.pixel_width / size.columns), int(size.pixel_height / size.rows)
+}
@@ -0,0 +1,6 @@
+package main
+
+// The Windows console doesn't report the size of its cells
+func terminalCellSize() (int, int) {
+	return 0, 0
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/rivo/tview"
+)
+
+// A very small syntax highlighter for source code served as plain text.
+// It only knows about keywords, strings, numbers and comments, which is
+// enough to make code easier to read without pulling in a full lexer.
+
+const (
+	HIGHLIGHT_KEYWORD = "[yellow]"
+	HIGHLIGHT_STRING  = "[green]"
+	HIGHLIGHT_NUMBER  = "[fuchsia]"
+	HIGHLIGHT_COMMENT = "[gray]"
+	HIGHLIGHT_RESET   = "[white]"
+)
+
+type syntax struct {
+	keywords     map[string]bool
+	lineComment  string
+	blockComment [2]string // Start and end, empty if the language has none
+	quotes       string    // Characters that start and end a string
+}
+
+func newSyntax(keywords string, lineComment string, blockStart string, blockEnd string, quotes string) *syntax {
+	keyword_set := make(map[string]bool)
+	for _, keyword := range strings.Fields(keywords) {
+		keyword_set[keyword] = true
+	}
+	return &syntax{
+		keywords:     keyword_set,
+		lineComment:  lineComment,
+		blockComment: [2]string{blockStart, blockEnd},
+		quotes:       quotes,
+	}
+}
+
+var cSyntax = newSyntax(`auto break case char const continue default do double else enum
+	extern float for goto if inline int long register return short signed sizeof
+	static struct switch typedef union unsigned void volatile while class namespace
+	template typename public private protected virtual new delete this true false
+	nullptr bool include define ifdef ifndef endif`, "//", "/*", "*/", `"'`)
+
+var syntaxes = map[string]*syntax{
+	"go": newSyntax(`break case chan const continue default defer else fallthrough
+		for func go goto if import interface map package range return select struct
+		switch type var nil true false`, "//", "/*", "*/", "\"'`"),
+	"c": cSyntax,
+	"python": newSyntax(`and as assert async await break class continue def del elif
+		else except finally for from global if import in is lambda nonlocal not or
+		pass raise return try while with yield None True False self`, "#", "", "", `"'`),
+	"sh": newSyntax(`if then else elif fi case esac for while until do done in
+		function return local export readonly exit`, "#", "", "", `"'`),
+	"javascript": newSyntax(`break case catch class const continue debugger default
+		delete do else export extends finally for function if import in instanceof
+		let new return super switch this throw try typeof var void while with yield
+		async await null undefined true false`, "//", "/*", "*/", "\"'`"),
+	"rust": newSyntax(`as break const continue crate else enum extern false fn for if
+		impl in let loop match mod move mut pub ref return self Self static struct
+		super trait true type unsafe use where while async await dyn`, "//", "/*", "*/", `"`),
+	"lua": newSyntax(`and break do else elseif end false for function goto if in
+		local nil not or repeat return then true until while`, "--", "", "", `"'`),
+}
+
+// File extensions and interpreter names mapped to the language they are
+var languageNames = map[string]string{
+	".go":    "go",
+	".c":     "c",
+	".h":     "c",
+	".cpp":   "c",
+	".hpp":   "c",
+	".cc":    "c",
+	".py":    "python",
+	".sh":    "sh",
+	".bash":  "sh",
+	".js":    "javascript",
+	".rs":    "rust",
+	".lua":   "lua",
+	"sh":     "sh",
+	"bash":   "sh",
+	"zsh":    "sh",
+	"ksh":    "sh",
+	"dash":   "sh",
+	"python": "python",
+	"node":   "javascript",
+	"lua":    "lua",
+}
+
+// Guess the language of a text file from the extension of its url, or from
+// a shebang line. Returns nil if it doesn't look like source code.
+func detectSyntax(_url string, content string) *syntax {
+	if parsed_url, err := url.Parse(_url); err == nil {
+		if name, ok := languageNames[strings.ToLower(path.Ext(parsed_url.Path))]; ok {
+			return syntaxes[name]
+		}
+	}
+	if !strings.HasPrefix(content, "#!") {
+		return nil
+	}
+	shebang := strings.Fields(strings.SplitN(content[2:], "\n", 2)[0])
+	if len(shebang) == 0 {
+		return nil
+	}
+	interpreter := path.Base(shebang[0])
+	if interpreter == "env" && len(shebang) > 1 {
+		interpreter = shebang[1]
+	}
+	// python3, lua5.3...
+	interpreter = strings.TrimRight(interpreter, "0123456789.")
+	if name, ok := languageNames[interpreter]; ok {
+		return syntaxes[name]
+	}
+	return nil
+}
+
+// Escape content and add color tags to it. Returns one line of tview
+// formatted text for each line of content.
+func (lang *syntax) highlight(content string) []string {
+	var lines []string
+	in_block_comment := false
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		var formatted strings.Builder
+		// Uncolored text is escaped in runs, since escaping "[", "x" and "]"
+		// one at a time would still leave a "[x]" tag
+		var plain strings.Builder
+		line = strings.TrimSuffix(line, "\r")
+		write := func(color string, text string) {
+			if color == "" {
+				plain.WriteString(text)
+				return
+			}
+			formatted.WriteString(tview.Escape(plain.String()))
+			plain.Reset()
+			formatted.WriteString(color + tview.Escape(text) + HIGHLIGHT_RESET)
+		}
+		block_start, block_end := lang.blockComment[0], lang.blockComment[1]
+		i := 0
+		for i < len(line) {
+			rest := line[i:]
+			switch {
+			case in_block_comment:
+				end := strings.Index(rest, block_end)
+				if end < 0 {
+					write(HIGHLIGHT_COMMENT, rest)
+					i = len(line)
+				} else {
+					write(HIGHLIGHT_COMMENT, rest[:end+len(block_end)])
+					i += end + len(block_end)
+					in_block_comment = false
+				}
+			case block_start != "" && strings.HasPrefix(rest, block_start):
+				write(HIGHLIGHT_COMMENT, block_start)
+				i += len(block_start)
+				in_block_comment = true
+			case lang.lineComment != "" && strings.HasPrefix(rest, lang.lineComment):
+				write(HIGHLIGHT_COMMENT, rest)
+				i = len(line)
+			case strings.IndexByte(lang.quotes, rest[0]) >= 0:
+				end := stringEnd(rest)
+				write(HIGHLIGHT_STRING, rest[:end])
+				i += end
+			case isWordByte(rest[0]):
+				end := 1
+				for end < len(rest) && isWordByte(rest[end]) {
+					end++
+				}
+				word := rest[:end]
+				if unicode.IsDigit(rune(word[0])) {
+					write(HIGHLIGHT_NUMBER, word)
+				} else if lang.keywords[word] {
+					write(HIGHLIGHT_KEYWORD, word)
+				} else {
+					write("", word)
+				}
+				i += end
+			default:
+				write("", rest[:1])
+				i++
+			}
+		}
+		formatted.WriteString(tview.Escape(plain.String()))
+		lines = append(lines, formatted.String())
+	}
+	return lines
+}
+
+// Length of the string literal at the start of text, including its quotes.
+// Unterminated strings run to the end of the line.
+func stringEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+		} else if text[i] == quote {
+			return i + 1
+		}
+	}
+	return len(text)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
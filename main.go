@@ -1,26 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"git.mills.io/prologic/go-gopher"
 	"github.com/adrg/xdg"
+	"github.com/atotto/clipboard"
 	"github.com/gdamore/tcell/v2"
 	"github.com/op/go-logging"
+	"github.com/ottopasuuna/viscacha/core"
 	"github.com/rivo/tview"
+	"golang.org/x/text/encoding/ianaindex"
 )
 
 // ## Architecture
 // A Handler is a function that takes a url and fetches the content. It returns a Page
-// which contains all the relavent information. The browser history is a list of Pages.
+// which contains all the relavent information. Handlers and pages live in the core
+// package so other programs can use them. Files that aren't shown are downloaded
+// in the background by core as well. The browser history is a list of Pages.
 // Various Render functions write the Page content to a tview TextView.
 
 var AppLog = logging.MustGetLogger("viscacha")
@@ -36,34 +53,128 @@ var DefaultKeyBindings = map[string]string{
 	"l":  "forward",
 	"\\": "show-logs",
 	":":  "cmd-prompt",
+	"b":  "bookmark-list",
+	"/":  "search",
+	"n":  "search-next",
+	"N":  "search-prev",
+	"o":  "open",
+	"t":  "tab-new",
+	"K":  "tab-next",
+	"J":  "tab-prev",
+	"x":  "tab-close",
+	"y":  "yank-url",
+	"r":  "reload",
+	"<":  "scroll-left",
+	">":  "scroll-right",
+	"?":  "help",
+	"q":  "quit",
+	"U":  "reopen",
+	"f":  "follow",
+	"H":  "home",
+	"Z":  "zen",
+	"v":  "visual",
+	"L":  "goto-line",
+	"R":  "raw-mode",
+	"-":  "margin-wider",
+	"+":  "margin-narrower",
+	// Keys other than characters are bound by their name
+	"Tab":     "link-next",
+	"Backtab": "link-prev",
 }
 
-const DEFAULT_LOG_PATH = "log.log"
-const DEFAULT_CONFIG_PATH = "config.json"
+// Relative to the XDG data and config directories
+const DEFAULT_LOG_PATH = "viscacha/viscacha.log"
+const DEFAULT_CONFIG_PATH = "viscacha/config.json"
+const LEGACY_CONFIG_PATH = "viscacha.json"
+const HOME_CONFIG_PATH = ".viscacha.json" // Relative to the home directory
+const LOCAL_CONFIG_PATH = "config.json"   // Relative to the working directory
 const DEFAULT_HOME_PAGE = "gopher://gopher.floodgap.com/"
+const DEFAULT_CACHE_SIZE = 50
+const DEFAULT_CACHE_TTL = 300
+const DEFAULT_SCROLL_LINES = 1
+const DEFAULT_PAGER = "less"
+const DEFAULT_EDITOR = "vi" // Used by edit-log when $EDITOR isn't set
+const DEFAULT_SHARE_FORMAT = "[%t](%u)"
+const DEFAULT_SCHEME = "gopher"
+const MESSAGE_LINE_ROW = 3
+const GRID_COLUMNS = 3 // Left margin, page and right margin
+const MARGIN_STEP = 4  // Columns added to or taken from each margin at a time
+const MIN_PAGE_WIDTH = 20
+const TAB_TITLE_WIDTH = 20
+const COMMAND_HISTORY_SIZE = 100
+const SCROLL_COLUMNS = 8 // Columns moved by scroll-left and scroll-right
+const LINK_DIGIT_TIMEOUT = 500 * time.Millisecond
+const DROPPED_PAGES_SIZE = 20 // Pages per tab that can be reopened
+const SPINNER_FRAMES = `|/-\`
+const SPINNER_INTERVAL = 100 * time.Millisecond
+
+// Time to type the second key of a sequence like gg
+const KEY_SEQUENCE_TIMEOUT = time.Second
+
+// Keys the page scrolls with by itself when they aren't bound
+const TEXTVIEW_KEYS = "gGjkhl"
+
+// The history page, linking to each page in the history with its index in a
+// query like "?index=3"
+const HISTORY_URL = "about:history"
+const HISTORY_INDEX_QUERY = "?index="
 
 // Keeps track of page history and navigation
 type HistoryManager struct {
-	page_history  []*Page
+	page_history  []*core.Page
 	history_index int
+	dropped_pages []*core.Page // Pages cut from the forward history, most recent last
+	restore_url   string       // Loaded when a tab from a restored session is first shown
+	overlay       *core.Page   // Shown over the current page without being added to the history
+	closed_index  int          // Where the tab was when it was closed, to reopen it there
+	load_seq      int          // Number of the latest page load, older loads are discarded
+	cancel_load   context.CancelFunc
+}
+
+// Start loading a page into this history, canceling the load before it if
+// it hasn't finished. Returns the load's number, which stops being load_seq
+// once a newer load starts, and the context to fetch with. The context must
+// be canceled once the load is done.
+func (manager *HistoryManager) startLoad() (int, context.Context, context.CancelFunc) {
+	if manager.cancel_load != nil {
+		manager.cancel_load()
+	}
+	manager.load_seq += 1
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.cancel_load = cancel
+	return manager.load_seq, ctx, cancel
 }
 
 // Navigates to a new page. All previous pages in the history are kept,
 // but pages forward in the history are dropped
-func (manager *HistoryManager) Navigate(page *Page) {
+func (manager *HistoryManager) Navigate(page *core.Page) {
+	manager.overlay = nil
 	if len(manager.page_history) == 0 { // initial page
-		manager.page_history = []*Page{page}
+		manager.page_history = []*core.Page{page}
 		manager.history_index = 0
 	} else {
+		// Keep the dropped pages so they can be reopened, the one right after
+		// the current page coming off the stack first
+		dropped := manager.page_history[manager.history_index+1:]
+		for i := len(dropped) - 1; i >= 0; i-- {
+			manager.dropped_pages = append(manager.dropped_pages, dropped[i])
+		}
+		if len(manager.dropped_pages) > DROPPED_PAGES_SIZE {
+			manager.dropped_pages = manager.dropped_pages[len(manager.dropped_pages)-DROPPED_PAGES_SIZE:]
+		}
 		manager.page_history = append(manager.page_history[:manager.history_index+1], page)
 		manager.history_index += 1
 	}
 }
 
-// Move backwards in the history
+// Move backwards in the history, or off the overlay to the page under it
 // Returns nil if on the first page
-func (manager *HistoryManager) Back() *Page {
-	var prev_page *Page
+func (manager *HistoryManager) Back() *core.Page {
+	if manager.overlay != nil {
+		manager.overlay = nil
+		return manager.CurrentPage()
+	}
+	var prev_page *core.Page
 	if manager.history_index > 0 {
 		manager.history_index -= 1
 		prev_page = manager.page_history[manager.history_index]
@@ -75,9 +186,10 @@ func (manager *HistoryManager) Back() *Page {
 
 // Move forwards in the history.
 // Returns nil if on the last page
-func (manager *HistoryManager) Forward() *Page {
-	var next_page *Page
+func (manager *HistoryManager) Forward() *core.Page {
+	var next_page *core.Page
 	if manager.history_index < len(manager.page_history)-1 {
+		manager.overlay = nil
 		manager.history_index += 1
 		next_page = manager.page_history[manager.history_index]
 	} else {
@@ -87,16 +199,64 @@ func (manager *HistoryManager) Forward() *Page {
 }
 
 // Get the current page
-func (manager *HistoryManager) CurrentPage() *Page {
+func (manager *HistoryManager) CurrentPage() *core.Page {
+	if manager.overlay != nil {
+		return manager.overlay
+	}
 	if len(manager.page_history) == 0 {
 		return nil
 	}
 	return manager.page_history[manager.history_index]
 }
 
+// Take the most recently dropped page off the stack of pages cut from the
+// forward history. Returns nil if there are none
+func (manager *HistoryManager) PopDropped() *core.Page {
+	n_dropped := len(manager.dropped_pages)
+	if n_dropped == 0 {
+		return nil
+	}
+	page := manager.dropped_pages[n_dropped-1]
+	manager.dropped_pages = manager.dropped_pages[:n_dropped-1]
+	return page
+}
+
+// Jump straight to the page at index in the history, keeping the pages
+// after it. Returns nil if there is no such page
+func (manager *HistoryManager) GoTo(index int) *core.Page {
+	if index < 0 || index >= len(manager.page_history) {
+		return nil
+	}
+	manager.overlay = nil
+	manager.history_index = index
+	return manager.page_history[index]
+}
+
+// Show page over the current one until another page is shown, without
+// adding it to the history
+func (manager *HistoryManager) ShowOverlay(page *core.Page) {
+	manager.overlay = page
+}
+
+// Get the page before the current one in the history.
+// Returns nil if on the first page
+func (manager *HistoryManager) PreviousPage() *core.Page {
+	if manager.overlay != nil && len(manager.page_history) > 0 {
+		return manager.page_history[manager.history_index]
+	}
+	if manager.history_index < 1 {
+		return nil
+	}
+	return manager.page_history[manager.history_index-1]
+}
+
 type Client struct {
 	PageView          *PageView
-	HistoryManager    *HistoryManager
+	HistoryManager    *HistoryManager // History of the active tab
+	Tabs              []*HistoryManager
+	closedTabs        []*HistoryManager // Most recently closed last
+	activeTab         int
+	TabBar            *tview.TextView
 	MessageLine       *tview.TextView
 	App               *tview.Application
 	GridLayout        *tview.Grid
@@ -104,14 +264,51 @@ type Client struct {
 	cli_lock          sync.Mutex      // For ensuring only one MessageLine input field open at a time
 	active_view       tview.Primitive // Keep track of the widget to give focus back to
 	loadingLock       sync.Mutex
+	stopSpinner       func() // Stops the spinner of the latest load
+	autoreloadPage    *core.Page
+	logPath           string // File the full log is written to, if any
+	autoreloadTimer   *time.Timer
 	commandNameToFunc map[string]func()
-	keyBindings       map[string]string
+	// Commands that take arguments when run from the command prompt
+	commandNameToArgsFunc map[string]func(args []string)
+	// Commands that can be given a count by typing a number before their key
+	commandNameToCountFunc map[string]func(count int)
+	keyBindings            map[string]string
+	Bookmarks              *Bookmarks
+	searchQuery            string
+	searchMatches          []int // Lines of searchPage containing searchQuery
+	searchIndex            int   // Currently highlighted match, -1 if none yet
+	searchPage             *core.Page
+	config                 UserConfig
+	configPath             string          // File config was read from, for reload-config and margin changes
+	downloads              *core.Downloads // Everything downloaded this session
+	Cache                  *PageCache
+	commandHistory         []string // Lines entered in the command prompt, oldest first
+	commandHistoryPath     string   // File to save commandHistory to, if any
+	linkDigits             string   // Digits typed so far to select a link
+	linkDigitsTimer        *time.Timer
+	count                  int    // Count typed before the key being handled, 0 if none
+	keyPrefix              string // First key of a key sequence being typed
+	keyPrefixTimer         *time.Timer
+	pageMargin             int  // Width of the margins on each side of the page
+	zen                    bool // Status and message lines are hidden
+	externalDisabled       bool // Web links are shown instead of opened in the browser
+	screenWidth            int
+	screenHeight           int
+	visitedUrls            map[string]bool // Urls opened this session, shared with PageView
+	downloadsView          *tview.TextView // Kept up to date while it is shown
 }
 
 func NewClient(userConfig UserConfig) *Client {
 	app := tview.NewApplication()
 
 	pageView := NewPageView()
+	pageView.LineNumbers = userConfig.LineNumbers
+	pageView.HideLinkNumbers = userConfig.HideLinkNumbers
+	pageView.Highlight = userConfig.Highlight
+	pageView.SetTheme(userConfig.Theme)
+	pageView.DetectInfoLinks = userConfig.DetectInfoLinks
+	pageView.ImageProtocol = resolveImageProtocol(userConfig.ImageProtocol)
 	textView := pageView.PageText
 	statusLine := pageView.StatusLine
 
@@ -122,82 +319,340 @@ func NewClient(userConfig UserConfig) *Client {
 	})
 	messageLine.SetBackgroundColor(tcell.ColorDefault)
 
+	tabBar := tview.NewTextView().
+		SetDynamicColors(true)
+	tabBar.SetBackgroundColor(tcell.ColorDefault)
+
 	gridLayout := tview.NewGrid().
-		SetRows(0, 1, 1).
+		SetRows(0, 1, 1, 1).
 		SetColumns(0).
 		SetBorders(false)
 
-	gridLayout.AddItem(textView, 0, 0, 1, 1, 0, 0, true)
-	gridLayout.AddItem(statusLine, 1, 0, 1, 1, 0, 0, false)
-	gridLayout.AddItem(messageLine, 2, 0, 1, 1, 0, 0, false)
+	// The page is in the middle column when it has margins, everything
+	// else spans all of them
+	gridLayout.AddItem(textView, 0, 0, 1, GRID_COLUMNS, 0, 0, true)
+	gridLayout.AddItem(tabBar, 1, 0, 1, GRID_COLUMNS, 0, 0, false)
+	gridLayout.AddItem(statusLine, 2, 0, 1, GRID_COLUMNS, 0, 0, false)
+	gridLayout.AddItem(messageLine, MESSAGE_LINE_ROW, 0, 1, GRID_COLUMNS, 0, 0, false)
 
-	// TODO: this makes it imposible to type the letter q in any text field...
-	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Rune() {
-		case 'q':
-			app.Stop()
-			return nil
-		}
-		return event
-	})
 	app.SetRoot(gridLayout, true).SetFocus(textView)
-	app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
-		screen.Clear()
-		return false
-	})
 
-	keyBindings := make(map[string]string)
-	for key, command := range DefaultKeyBindings {
-		keyBindings[key] = command
-	}
-	if userConfig.Bindings != nil {
-		for key, command := range userConfig.Bindings {
-			keyBindings[key] = command
-		}
-	}
+	keyBindings := mergeKeyBindings(userConfig.Bindings)
 
+	visitedUrls := make(map[string]bool)
+	pageView.Visited = visitedUrls
+	history := &HistoryManager{}
+	cache := NewPageCache(userConfig.CacheSize, time.Duration(userConfig.CacheTTL)*time.Second)
 	client := Client{
 		PageView:       pageView,
-		HistoryManager: &HistoryManager{},
+		HistoryManager: history,
+		Tabs:           []*HistoryManager{history},
+		TabBar:         tabBar,
 		MessageLine:    messageLine,
 		App:            app,
 		GridLayout:     gridLayout,
 		active_view:    pageView.PageText,
 		keyBindings:    keyBindings,
+		config:         userConfig,
+		Cache:          cache,
+		visitedUrls:    visitedUrls,
+		downloads:      core.NewDownloads(),
 	}
 	client.initCommandNameMap()
+	client.UpdateTabBar()
+	app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
+		screen.Clear()
+		width, height := screen.Size()
+		client.layoutMargins(width)
+		if width != client.screenWidth || height != client.screenHeight {
+			client.screenWidth, client.screenHeight = width, height
+			// Widgets only learn their new size while being drawn
+			app.QueueUpdateDraw(client.resized)
+		}
+		return false
+	})
+	app.SetAfterDrawFunc(func(screen tcell.Screen) {
+		pageView.DrawGraphics(screen, os.Stdout)
+	})
 	textView.SetInputCapture(client.PageInputHandler)
 	return &client
 }
 
+// The default key bindings with the user's bindings added on top
+func mergeKeyBindings(bindings map[string]string) map[string]string {
+	keyBindings := make(map[string]string)
+	for key, command := range DefaultKeyBindings {
+		keyBindings[key] = command
+	}
+	for key, command := range bindings {
+		keyBindings[key] = command
+	}
+	return keyBindings
+}
+
 // User configurable settings are stored in here
 type UserConfig struct {
-	Bindings map[string]string `json:"bindings"`
-	HomePage string            `json:"homepage"`
+	Bindings           map[string]string `json:"bindings"`
+	HomePage           string            `json:"homepage"`
+	Timeout            int               `json:"timeout"` // seconds
+	ExternalBrowser    string            `json:"browser"` // Command used to open http links, with %s for the url
+	DownloadDir        string            `json:"download_dir"`
+	CacheSize          int               `json:"cache_size"` // pages, negative to disable
+	CacheTTL           int               `json:"cache_ttl"`  // seconds
+	LineNumbers        bool              `json:"line_numbers"`
+	HideLinkNumbers    bool              `json:"hide_link_numbers"`    // Leave the [1] in front of gopher directory items out
+	SaveCommandHistory bool              `json:"save_command_history"` // Keep command history across restarts
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"` // Accept any TLS certificate for gophers
+	ConfirmQuit        bool              `json:"confirm_quit"`
+	ConfirmBrowser     bool              `json:"confirm_browser"`    // Ask before opening links in the browser
+	QuietUnboundKeys   bool              `json:"quiet_unbound_keys"` // Don't point out keys that aren't bound to anything
+	Highlight          bool              `json:"highlight"`          // Syntax highlighting for source code
+	Aliases            map[string]string `json:"aliases"`            // Short names for urls, used in the command prompt
+	Theme              Theme             `json:"theme"`
+	ScrollLines        int               `json:"scroll_lines"`      // Lines moved by scroll-up and scroll-down
+	HalfPageLines      int               `json:"half_page_lines"`   // Lines moved by the half page scrolls, 0 for half the height
+	Pager              string            `json:"pager"`             // Program and arguments used by the pager command
+	Charset            string            `json:"charset"`           // Encoding of gopher text, like "cp437". Guessed if empty
+	DetectInfoLinks    bool              `json:"detect_info_links"` // Number urls found in gopher info lines as links
+	RestoreSession     bool              `json:"restore_session"`   // Reopen the tabs from last time when started without a url
+	MaxWidth           int               `json:"max_width"`         // Columns the page is centered in, 0 for the full width
+	InlineImages       bool              `json:"inline_images"`     // Show gopher images in the page instead of downloading them
+	ImageProtocol      string            `json:"image_protocol"`    // How inline images are drawn: auto, kitty, sixel, blocks or none
+	Decompress         bool              `json:"decompress"`        // Show gzipped gopher text files decompressed
+	EmailClient        string            `json:"email_client"`      // Program and arguments used for mailto links, $MAILER if empty
+	LogRequests        bool              `json:"log_requests"`      // Log the time and size of every gopher request
+	MaxContentSize     int64             `json:"max_content_size"`  // Bytes of a gopher page to show, bigger files are downloaded
+	AudioPlayer        string            `json:"audio_player"`      // Program and arguments that play gopher sound files, downloaded only if empty
+	ShareFormat        string            `json:"share_format"`      // Template for yank-share, see formatShare
+	DefaultScheme      string            `json:"default_scheme"`    // Scheme for hosts typed in the command prompt without one
+}
+
+// Colors used to draw pages, given as a name like "skyblue" or as "#87ceeb"
+type Theme struct {
+	Link      string `json:"link"` // Link numbers
+	Text      string `json:"text"`
+	Directory string `json:"directory"`
+	Query     string `json:"query"`
+	HTML      string `json:"html"`
+	Binary    string `json:"binary"` // Files that get downloaded
+	Unknown   string `json:"unknown"`
+	Info      string `json:"info"`
+	Visited   string `json:"visited"` // Links that were already opened
+	StatusFg  string `json:"status_fg"`
+	StatusBg  string `json:"status_bg"`
+}
+
+var DefaultTheme = Theme{
+	Link:      "green",
+	Text:      "white",
+	Directory: "skyblue",
+	Query:     "violet",
+	HTML:      "yellow",
+	Binary:    "orange",
+	Unknown:   "red",
+	Info:      "white",
+	Visited:   "mediumpurple",
+	StatusFg:  "black",
+	StatusBg:  "white",
+}
+
+// Use the default for colors that are left out or not recognized
+func (theme *Theme) fillDefaults() {
+	colors := []struct {
+		value    *string
+		fallback string
+	}{
+		{&theme.Link, DefaultTheme.Link},
+		{&theme.Text, DefaultTheme.Text},
+		{&theme.Directory, DefaultTheme.Directory},
+		{&theme.Query, DefaultTheme.Query},
+		{&theme.HTML, DefaultTheme.HTML},
+		{&theme.Binary, DefaultTheme.Binary},
+		{&theme.Unknown, DefaultTheme.Unknown},
+		{&theme.Info, DefaultTheme.Info},
+		{&theme.Visited, DefaultTheme.Visited},
+		{&theme.StatusFg, DefaultTheme.StatusFg},
+		{&theme.StatusBg, DefaultTheme.StatusBg},
+	}
+	for _, color := range colors {
+		if *color.value == "" {
+			*color.value = color.fallback
+		} else if *color.value != "default" && tcell.GetColor(*color.value) == tcell.ColorDefault {
+			AppLog.Errorf("Unknown theme color \"%s\"", *color.value)
+			*color.value = color.fallback
+		}
+	}
+}
+
+// The places a config file is looked for, most important first, given the
+// home directory, empty if it isn't known, and the XDG config directories
+func configFileLocations(home string, config_home string, config_dirs []string) []string {
+	locations := []string{filepath.Join(config_home, DEFAULT_CONFIG_PATH)}
+	// Where older versions looked for it
+	for _, dir := range append([]string{config_home}, config_dirs...) {
+		locations = append(locations, filepath.Join(dir, LEGACY_CONFIG_PATH))
+	}
+	if home != "" {
+		locations = append(locations, filepath.Join(home, HOME_CONFIG_PATH))
+	}
+	return append(locations, LOCAL_CONFIG_PATH)
+}
+
+// The first config file that exists of those in configFileLocations. If
+// there is none, the XDG location is returned so one created there later is
+// found by reload-config.
+func findConfigFile(home string, config_home string, config_dirs []string) string {
+	locations := configFileLocations(home, config_home, config_dirs)
+	for _, location := range locations {
+		if _, err := os.Stat(location); err == nil {
+			return location
+		}
+	}
+	return locations[0]
 }
 
 // Read the users json config file. If the file does not exist, return a default one.
 func ReadConfig(path string) UserConfig {
+	userconfig, err := parseConfig(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		AppLog.Error(err)
+	}
+	return userconfig
+}
+
+// Like ReadConfig, but returns an error instead of logging it when the file
+// doesn't exist or can't be read or parsed. The config returned along with
+// an error still has defaults filled in.
+func parseConfig(path string) (UserConfig, error) {
 	var userconfig UserConfig
 	content, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
-		return UserConfig{
-			Bindings: DefaultKeyBindings,
-			HomePage: DEFAULT_HOME_PAGE,
-		}
+		userconfig.Bindings = DefaultKeyBindings
+		userconfig.fillDefaults()
+		return userconfig, fmt.Errorf("Config file \"%s\" does not exist: %w", path, err)
 	}
 	if err != nil {
-		AppLog.Errorf("Failed to read config file \"%s\"\n\t%v", path, err)
+		userconfig.fillDefaults()
+		return userconfig, fmt.Errorf("Failed to read config file \"%s\"\n\t%v", path, err)
 	}
 	err = json.Unmarshal(content, &userconfig)
+	userconfig.fillDefaults()
+	if err != nil {
+		return userconfig, fmt.Errorf("Failed to parse config file \"%s\"\n\t%v", path, err)
+	}
+	return userconfig, nil
+}
+
+// Set max_width in the config file at path, leaving the other settings in it
+// as they are. The file is created if it doesn't exist yet.
+func saveMaxWidth(path string, max_width int) error {
+	settings := make(map[string]json.RawMessage)
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		// A file that can't be parsed is left for the user to fix
+		if err := json.Unmarshal(content, &settings); err != nil {
+			return err
+		}
+	}
+	settings["max_width"] = json.RawMessage(strconv.Itoa(max_width))
+	content, err = json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
-		AppLog.Errorf("Failed to parse config file \"%s\"\n\t%v", path, err)
+		return err
 	}
-	// Fill in Default values
-	if userconfig.HomePage == "" {
-		userconfig.HomePage = DEFAULT_HOME_PAGE
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// The command that opens urls in the user's preferred programs
+func defaultBrowser() string {
+	if runtime.GOOS == "darwin" {
+		return "open"
+	}
+	return "xdg-open"
+}
+
+// The settings used when fetching pages
+func (config *UserConfig) coreSettings() core.Config {
+	return core.Config{
+		Timeout:            config.Timeout,
+		DownloadDir:        config.DownloadDir,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		Charset:            config.Charset,
+		InlineImages:       config.InlineImages,
+		LogRequests:        config.LogRequests,
+		MaxContentSize:     config.MaxContentSize,
+		AudioPlayer:        config.AudioPlayer,
+		Decompress:         config.Decompress,
+	}
+}
+
+// Fill in Default values for settings the user left out
+func (config *UserConfig) fillDefaults() {
+	if config.HomePage == "" {
+		config.HomePage = DEFAULT_HOME_PAGE
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = core.DEFAULT_TIMEOUT
+	}
+	if config.ExternalBrowser == "" {
+		config.ExternalBrowser = defaultBrowser()
+	}
+	if config.DownloadDir == "" {
+		config.DownloadDir = core.DEFAULT_DOWNLOAD_LOCAITON
+	}
+	if config.CacheSize == 0 {
+		config.CacheSize = DEFAULT_CACHE_SIZE
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DEFAULT_CACHE_TTL
+	}
+	config.Theme.fillDefaults()
+	if config.ScrollLines <= 0 {
+		config.ScrollLines = DEFAULT_SCROLL_LINES
+	}
+	if config.Pager == "" {
+		config.Pager = os.Getenv("PAGER")
+	}
+	if config.Pager == "" {
+		config.Pager = DEFAULT_PAGER
+	}
+	if config.EmailClient == "" {
+		config.EmailClient = os.Getenv("MAILER")
+	}
+	if config.MaxWidth < 0 {
+		config.MaxWidth = 0
+	}
+	if config.ShareFormat == "" {
+		config.ShareFormat = DEFAULT_SHARE_FORMAT
+	}
+	config.DefaultScheme = strings.TrimSuffix(config.DefaultScheme, "://")
+	if config.DefaultScheme == "" {
+		config.DefaultScheme = DEFAULT_SCHEME
+	}
+	if config.MaxContentSize <= 0 {
+		config.MaxContentSize = core.DEFAULT_MAX_CONTENT_SIZE
+	}
+	switch config.ImageProtocol {
+	case "":
+		config.ImageProtocol = IMAGE_PROTOCOL_AUTO
+	case IMAGE_PROTOCOL_AUTO, IMAGE_PROTOCOL_KITTY, IMAGE_PROTOCOL_SIXEL, IMAGE_PROTOCOL_BLOCKS,
+		IMAGE_PROTOCOL_NONE:
+	default:
+		AppLog.Errorf("Unknown image_protocol \"%s\", detecting it instead", config.ImageProtocol)
+		config.ImageProtocol = IMAGE_PROTOCOL_AUTO
+	}
+	if config.Charset != "" && config.Charset != "auto" {
+		if encoding, err := ianaindex.IANA.Encoding(config.Charset); err != nil || encoding == nil {
+			AppLog.Errorf("Unknown charset \"%s\", guessing instead", config.Charset)
+			config.Charset = ""
+		}
 	}
-	return userconfig
 }
 
 func (c *Client) initCommandNameMap() {
@@ -216,197 +671,1106 @@ func (c *Client) initCommandNameMap() {
 		"root":              c.CommandGoToRoot,
 		"show-logs":         c.CommandViewLogs,
 		"cmd-prompt":        c.CommandCmdPrompt,
+		"bookmark-list":     c.CommandBookmarkList,
+		"search":            c.CommandSearch,
+		"search-next":       c.CommandSearchNext,
+		"search-prev":       c.CommandSearchPrev,
+		"open":              c.CommandOpenUrl,
+		"tab-new":           c.CommandTabNew,
+		"tab-next":          c.CommandTabNext,
+		"tab-prev":          c.CommandTabPrev,
+		"tab-close":         c.CommandTabClose,
+		"yank-url":          c.CommandYankUrl,
+		"reload":            c.CommandReload,
+		"downloads":         c.CommandDownloads,
+		"line-numbers":      c.CommandToggleLineNumbers,
+		"link-numbers":      c.CommandToggleLinkNumbers,
+		"wrap":              c.CommandToggleWrap,
+		"scroll-left":       c.CommandScrollLeft,
+		"scroll-right":      c.CommandScrollRight,
+		"help":              c.CommandHelp,
+		"quit":              c.CommandQuit,
+		"history":           c.CommandHistory,
+		"link-next":         c.CommandLinkNext,
+		"link-prev":         c.CommandLinkPrev,
+		"raw":               c.CommandToggleRaw,
+		"raw-mode":          c.CommandRawMode,
+		"reopen":            c.CommandReopen,
+		"pager":             c.CommandPager,
+		"follow":            c.CommandFollow,
+		"edit-selector":     c.CommandEditSelector,
+		"margin-wider":      c.CommandMarginWider,
+		"margin-narrower":   c.CommandMarginNarrower,
+		"home":              c.CommandHome,
+		"zen":               c.CommandZen,
+		"copy-page":         c.CommandCopyPage,
+		"toggle-external":   c.CommandToggleExternal,
+		"edit-log":          c.CommandEditLog,
+		"info":              c.CommandInfo,
+		"reload-config":     c.CommandReloadConfig,
+		"visual":            c.CommandVisual,
+		"sort":              c.CommandSort,
+	}
+	c.commandNameToArgsFunc = map[string]func(args []string){
+		"bookmark-add": c.CommandBookmarkAdd,
+		"bookmark-del": c.CommandBookmarkDel,
+		"bookmark-tag": c.CommandBookmarkTag,
+		"yank-link":    c.CommandYankLink,
+		"save":         c.CommandSave,
+		"tab-follow":   c.CommandTabFollow,
+		"peek":         c.CommandPeek,
+		"link-find":    c.CommandLinkFind,
+		"pipe":         c.CommandPipe,
+		"filter":       c.CommandFilter,
+		"goto-line":    c.CommandGotoLine,
+		"yank-share":   c.CommandYankShare,
+		"autoreload":   c.CommandAutoreload,
+	}
+	c.commandNameToCountFunc = map[string]func(count int){
+		"scroll-up": func(count int) {
+			c.scrollLines(-count * c.config.ScrollLines)
+		},
+		"scroll-down": func(count int) {
+			c.scrollLines(count * c.config.ScrollLines)
+		},
+		"scroll-hpage-up": func(count int) {
+			c.scrollLines(-count * c.halfPageLines())
+		},
+		"scroll-hpage-down": func(count int) {
+			c.scrollLines(count * c.halfPageLines())
+		},
+		"scroll-left": func(count int) {
+			c.scrollColumns(-count * SCROLL_COLUMNS)
+		},
+		"scroll-right": func(count int) {
+			c.scrollColumns(count * SCROLL_COLUMNS)
+		},
+		// Like in vi, 10G goes to line 10
+		"scroll-top":    c.gotoLine,
+		"scroll-bottom": c.gotoLine,
 	}
 }
 
 func (c *Client) BuildCommandLine(label string, handler func(commandLine *tview.InputField, key tcell.Key)) {
+	c.buildCommandLine(label, "", false, nil, handler)
+}
+
+// Open a command line that runs the entered command, starting out containing
+// text. Up and Down browse the previously entered commands.
+func (c *Client) BuildCommandPrompt(label string, text string) {
+	c.buildCommandLine(label, text, true, nil, func(commandLine *tview.InputField, key tcell.Key) {
+		if key == tcell.KeyEnter {
+			c.addCommandHistory(commandLine.GetText())
+			c.RunCommand(commandLine.GetText())
+		}
+	})
+}
+
+// If changed isn't nil it is called with the text after every edit.
+func (c *Client) buildCommandLine(label string, text string, command_prompt bool, changed func(text string), handler func(commandLine *tview.InputField, key tcell.Key)) {
 	go func() {
 		c.cli_lock.Lock()
 		c.App.QueueUpdateDraw(func() {
+			// The command line takes the place of the message line
+			was_zen := c.zen
+			c.setZen(false)
 			commandLine := tview.NewInputField().
-				SetLabel(label)
+				SetLabel(label).
+				SetText(text)
+			if command_prompt {
+				commandLine.SetInputCapture(c.completionInputHandler(commandLine,
+					c.commandHistoryInputHandler(commandLine)))
+			}
+			if changed != nil {
+				commandLine.SetChangedFunc(changed)
+			}
 			commandLine.SetDoneFunc(func(key tcell.Key) {
 				handler(commandLine, key)
 				c.GridLayout.RemoveItem(commandLine)
-				c.GridLayout.AddItem(c.MessageLine, 2, 0, 1, 1, 0, 0, false)
+				// The zen command toggles it from what it was before the prompt
+				c.setZen(was_zen != c.zen)
 				c.App.SetFocus(c.active_view)
 				c.cli_lock.Unlock()
 			})
 			c.GridLayout.RemoveItem(c.MessageLine)
-			c.GridLayout.AddItem(commandLine, 2, 0, 1, 1, 0, 0, true)
+			c.GridLayout.AddItem(commandLine, MESSAGE_LINE_ROW, 0, 1, GRID_COLUMNS, 0, 0, true)
 			c.App.SetFocus(commandLine)
 		})
 	}()
 }
 
-func (client *Client) GotoUrl(url string) {
-	client.SaveScroll()
-	fmt.Fprintln(client.MessageLine, "Loading...")
-	client.loadingLock.Lock()
-	go func() {
-		page, success := GopherHandler(url)
-		if !success {
-			AppLog.Error("Failed to get gopher url")
-		} else if page != nil {
-			client.App.QueueUpdateDraw(func() {
-				client.PageView.RenderPage(page)
-				client.HistoryManager.Navigate(page)
-				client.MessageLine.Clear()
-			})
+// Input handler for a command line that completes the text on Tab. If there
+// are several completions a list is shown, and while it is open the arrow
+// keys go to the InputField for choosing one. Other keys are passed on to
+// other_keys.
+func (c *Client) completionInputHandler(commandLine *tview.InputField, other_keys func(event *tcell.EventKey) *tcell.EventKey) func(event *tcell.EventKey) *tcell.EventKey {
+	completing := false
+	show_completions := false
+	// The InputField asks for completions after every change, only give them
+	// when Tab was pressed
+	commandLine.SetAutocompleteFunc(func(text string) []string {
+		if !show_completions {
+			return nil
 		}
-		client.loadingLock.Unlock()
-	}()
+		return c.completions(text)
+	})
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			if completing {
+				return event
+			}
+			matches := c.completions(commandLine.GetText())
+			if len(matches) == 1 {
+				commandLine.SetText(matches[0])
+				return nil
+			}
+			show_completions = true
+			commandLine.Autocomplete()
+			show_completions = false
+			completing = len(matches) > 1
+			return nil
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyBacktab:
+			if completing {
+				return event
+			}
+		default:
+			completing = false
+		}
+		return other_keys(event)
+	}
 }
 
-func (client *Client) SaveScroll() {
-	page := client.HistoryManager.CurrentPage()
-	if page != nil {
-		row, _ := client.PageView.PageText.GetScrollOffset()
-		page.ScrollOffset = row
+// Command names, previously entered commands and bookmarked urls that start
+// with text, ignoring case
+func (c *Client) completions(text string) []string {
+	var candidates []string
+	for command := range c.commandNameToFunc {
+		candidates = append(candidates, command)
+	}
+	for command := range c.commandNameToArgsFunc {
+		candidates = append(candidates, command)
+	}
+	for alias := range c.config.Aliases {
+		candidates = append(candidates, alias)
+	}
+	candidates = append(candidates, c.commandHistory...)
+	if c.Bookmarks != nil {
+		for _, bookmark := range c.Bookmarks.Entries {
+			candidates = append(candidates, bookmark.Url)
+		}
+	}
+	prefix := strings.ToLower(text)
+	seen := make(map[string]bool)
+	var matches []string
+	for _, candidate := range candidates {
+		if !seen[candidate] && strings.HasPrefix(strings.ToLower(candidate), prefix) {
+			seen[candidate] = true
+			matches = append(matches, candidate)
+		}
 	}
+	sort.Strings(matches)
+	return matches
 }
 
-func (c *Client) PageInputHandler(event *tcell.EventKey) *tcell.EventKey {
-	if c.MessageLine.GetText(true) != "Loading...\n" {
-		c.MessageLine.Clear()
-	}
-	binding, is_bound := c.keyBindings[string(event.Rune())]
-	if is_bound {
-		cmd_func, is_cmd := c.commandNameToFunc[binding]
-		if is_cmd {
-			cmd_func()
+// Input handler for a command line that replaces its text with older or newer
+// entries from the command history on Up and Down
+func (c *Client) commandHistoryInputHandler(commandLine *tview.InputField) func(event *tcell.EventKey) *tcell.EventKey {
+	history_index := len(c.commandHistory)
+	draft := commandLine.GetText()
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp:
+			if history_index == len(c.commandHistory) {
+				draft = commandLine.GetText()
+			}
+			if history_index > 0 {
+				history_index -= 1
+				commandLine.SetText(c.commandHistory[history_index])
+			}
+			return nil
+		case tcell.KeyDown:
+			if history_index < len(c.commandHistory)-1 {
+				history_index += 1
+				commandLine.SetText(c.commandHistory[history_index])
+			} else if history_index == len(c.commandHistory)-1 {
+				history_index += 1
+				commandLine.SetText(draft)
+			}
 			return nil
-		} else {
-			AppLog.Error("Not a valid command: \"%s\"", binding)
 		}
+		return event
 	}
+}
 
-	// Bind number keys to quick select links
-	for i := 1; i <= 9; i++ {
-		if (event.Rune()) == rune(i+48) {
-			current_page := c.HistoryManager.CurrentPage()
-			c.FollowLink(current_page, i)
+// Remember a line entered in the command prompt, and save the history to
+// disk if that is enabled
+func (c *Client) addCommandHistory(command string) {
+	n_commands := len(c.commandHistory)
+	if command == "" || (n_commands > 0 && c.commandHistory[n_commands-1] == command) {
+		return
+	}
+	c.commandHistory = append(c.commandHistory, command)
+	if len(c.commandHistory) > COMMAND_HISTORY_SIZE {
+		c.commandHistory = c.commandHistory[len(c.commandHistory)-COMMAND_HISTORY_SIZE:]
+	}
+	if c.commandHistoryPath != "" {
+		content := strings.Join(c.commandHistory, "\n") + "\n"
+		if err := ioutil.WriteFile(c.commandHistoryPath, []byte(content), 0644); err != nil {
+			AppLog.Errorf("Failed to save command history: %v", err)
 		}
 	}
-	return event
 }
 
-func (c *Client) FollowLink(page *Page, link_num int) {
-	if link_num > 0 && int(link_num) <= len(page.Links) {
-		link := page.Links[link_num-1]
-		if link.Type == GopherQuery {
-			// get input
-			c.BuildCommandLine("Query: ", func(commandLine *tview.InputField, key tcell.Key) {
-				search_term := commandLine.GetText()
-				query_url, err := GopherQueryUrl(link, search_term)
-				if err != nil {
-					return
-				}
-				c.GotoUrl(query_url)
-			})
-
-		} else {
-			c.GotoUrl(link.Url)
-		}
-		go func() {
-			c.loadingLock.Lock()
-			c.loadingLock.Unlock()
-			new_page := c.HistoryManager.CurrentPage()
-			new_page.Parent = page
-			new_page.LinkIndex = link_num
-		}()
-	} else {
-		AppLog.Errorf("No link #%d on the current page", link_num)
+// Read a command history saved by addCommandHistory
+func LoadCommandHistory(path string) []string {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		AppLog.Errorf("Failed to read command history \"%s\"\n\t%v", path, err)
+		return nil
 	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
 }
 
-func (c *Client) CommandCmdPrompt() {
-	c.BuildCommandLine(": ", func(commandLine *tview.InputField, key tcell.Key) {
-		if key == tcell.KeyEnter {
-			// Dispatch command
-			commandString := commandLine.GetText()
-			cmd := strings.Split(commandString, " ")[0]
-			cmd_func, in_cmd_map := c.commandNameToFunc[cmd]
-			if in_cmd_map {
-				cmd_func()
-			} else {
-				if link_num, err := strconv.ParseInt(cmd, 10, 32); err == nil {
-					current_page := c.HistoryManager.CurrentPage()
-					c.FollowLink(current_page, int(link_num))
-				} else if url, err := url.Parse(commandString); err == nil && url.Scheme != "" {
-					switch url.Scheme {
-					case "gopher":
-						c.GotoUrl(commandString)
-					default:
-						AppLog.Errorf("Protocol \"%s\" not supported", url.Scheme)
-					}
-				} else {
-					AppLog.Errorf("Not a valid command: \"%s\"", cmd)
-				}
-			}
-		}
-	})
+// Navigate to url, showing the cached page if there is one
+func (client *Client) GotoUrl(url string) {
+	client.gotoLink(url, nil, 0)
 }
 
-func (c *Client) CommandScrollUp() {
-	curr_row, _ := c.PageView.PageText.GetScrollOffset()
-	scrollDest := curr_row - 1
-	if scrollDest <= 0 {
-		scrollDest = 0
+// Navigate to url as link number link_index of parent. The parent is set on
+// the new page right before it is added to the history, so next/prev always
+// see the page it was opened from.
+func (client *Client) gotoLink(url string, parent *core.Page, link_index int) {
+	url, anchor := splitUrlAnchor(url)
+	if client.gotoHistoryEntry(url) {
+		return
 	}
-	c.PageView.PageText.ScrollTo(scrollDest, 0)
-	c.PageView.UpdateStatus()
+	// Bookmark pages are made here rather than fetched
+	if page := client.Bookmarks.Page(url); page != nil {
+		page.Parent = parent
+		page.LinkIndex = link_index
+		client.ShowPage(page)
+		return
+	}
+	if core.GopherQueryNeedsInput(url) {
+		client.PromptGopherQuery(url)
+		return
+	}
+	client.visitedUrls[url] = true
+	client.loadPage(client.HistoryManager, url, anchor, parent, link_index)
 }
 
-func (c *Client) CommandScrollDown() {
-	curr_row, _ := c.PageView.PageText.GetScrollOffset()
-	scrollDest := curr_row + 1
-	bottom := c.PageView.NumLines()
-	if scrollDest >= bottom {
-		scrollDest = bottom
+// Split a fragment that points into the page off url, returning the url to
+// fetch and the fragment. "L42" points at line 42, "search=foo" at the first
+// match of foo. Other fragments are kept in the url.
+func splitUrlAnchor(url_str string) (string, string) {
+	hash := strings.Index(url_str, "#")
+	if hash < 0 {
+		return url_str, ""
 	}
-	c.PageView.PageText.ScrollTo(scrollDest, 0)
-	c.PageView.UpdateStatus()
+	anchor, err := url.PathUnescape(url_str[hash+1:])
+	if err != nil {
+		return url_str, ""
+	}
+	if strings.HasPrefix(anchor, "L") {
+		if line, err := strconv.Atoi(anchor[1:]); err == nil && line > 0 {
+			return url_str[:hash], anchor
+		}
+	}
+	if strings.HasPrefix(anchor, "search=") && len(anchor) > len("search=") {
+		return url_str[:hash], anchor
+	}
+	return url_str, ""
 }
 
-func (c *Client) CommandScrollTop() {
-	c.PageView.PageText.ScrollToBeginning()
-	c.PageView.UpdateStatus()
+// Scroll the page just shown to where an anchor from splitUrlAnchor points
+func (client *Client) applyAnchor(anchor string) {
+	if strings.HasPrefix(anchor, "search=") {
+		client.searchQuery = strings.TrimPrefix(anchor, "search=")
+		client.searchPage = nil
+		client.CommandSearchNext()
+	} else if line, err := strconv.Atoi(strings.TrimPrefix(anchor, "L")); err == nil {
+		client.gotoLine(line)
+	}
 }
 
-func (c *Client) CommandScrollBottom() {
-	c.PageView.PageText.ScrollToEnd()
-	c.PageView.UpdateStatus()
+// Load url into the tab with the given history. The page is only shown if
+// that is the active tab once it has loaded, and then scrolled to anchor if
+// it isn't empty.
+func (client *Client) loadPage(history *HistoryManager, url string, anchor string, parent *core.Page, link_index int) {
+	if history == client.HistoryManager {
+		client.SaveScroll()
+		client.stopAutoreload()
+	}
+	if page := client.Cache.Get(url); page != nil {
+		page.Parent = parent
+		page.LinkIndex = link_index
+		if history == client.HistoryManager {
+			client.ShowPage(page)
+			if anchor != "" {
+				client.applyAnchor(anchor)
+			}
+		} else {
+			history.Navigate(page)
+			client.UpdateTabBar()
+		}
+		return
+	}
+	config := client.fetchConfig()
+	seq, ctx, cancel := history.startLoad()
+	stopSpinner := client.startSpinner(config.Received)
+	go func() {
+		defer cancel()
+		// Loads are done one at a time. One that was waiting for an older
+		// load may have been replaced by a newer one in the meantime.
+		client.loadingLock.Lock()
+		defer client.loadingLock.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		page, err := core.FetchContext(ctx, config, url)
+		if ctx.Err() != nil {
+			AppLog.Debugf("Load of %s replaced by a newer one", url)
+			return
+		}
+		if err != nil {
+			AppLog.Errorf("Failed to load %s: %v", url, err)
+			var connect_err *core.ConnectError
+			if errors.As(err, &connect_err) {
+				client.App.QueueUpdateDraw(func() {
+					client.showConnectError(url, connect_err, func() {
+						client.loadPage(history, url, anchor, parent, link_index)
+					})
+				})
+			}
+		} else if page != nil {
+			client.Cache.Put(page)
+			client.App.QueueUpdateDraw(func() {
+				if seq != history.load_seq {
+					return
+				}
+				// The page may have been redirected
+				client.visitedUrls[page.Url] = true
+				page.Parent = parent
+				page.LinkIndex = link_index
+				history.Navigate(page)
+				client.UpdateTabBar()
+				client.MessageLine.Clear()
+				if history == client.HistoryManager {
+					client.PageView.RenderPage(page)
+					if anchor != "" {
+						client.applyAnchor(anchor)
+					}
+				}
+			})
+		}
+		client.App.QueueUpdateDraw(stopSpinner)
+	}()
 }
 
-func (c *Client) CommandScrollHalfDown() {
-	_, _, _, height := c.PageView.PageText.GetRect()
-	curr_row, _ := c.PageView.PageText.GetScrollOffset()
-	scrollDest := curr_row + height/2
-	bottom := c.PageView.NumLines()
-	if scrollDest >= bottom {
-		scrollDest = bottom
+// The settings for a fetch started now, with a counter of its own for the
+// bytes received. Taken on the UI goroutine when the load starts, so
+// reloading the config doesn't change them part way through.
+func (client *Client) fetchConfig() core.Config {
+	config := client.config.coreSettings()
+	// Images the terminal can't draw go to the download directory, to be
+	// opened with something that can
+	if client.PageView.ImageProtocol == IMAGE_PROTOCOL_NONE {
+		config.InlineImages = false
 	}
-	c.PageView.PageText.ScrollTo(scrollDest, 0)
-	c.PageView.UpdateStatus()
+	config.Received = new(int64)
+	config.DownloadProgress = func(download *core.Download) {
+		client.App.QueueUpdateDraw(client.refreshDownloads)
+	}
+	config.Downloads = client.downloads
+	return config
 }
 
-func (c *Client) CommandScrollHalfUp() {
-	_, _, _, height := c.PageView.PageText.GetRect()
-	curr_row, _ := c.PageView.PageText.GetScrollOffset()
-	scrollDest := curr_row - height/2
-	if scrollDest <= 0 {
-		scrollDest = 0
-	}
-	c.PageView.PageText.ScrollTo(scrollDest, 0)
-	c.PageView.UpdateStatus()
+// Pop up a dialog saying url could not be loaded because of err, with a
+// button to call retry
+func (client *Client) showConnectError(url string, err error, retry func()) {
+	modal := tview.NewModal().
+		SetText(tview.Escape(fmt.Sprintf("Failed to load %s\n\n%v", url, err))).
+		AddButtons([]string{"Retry", "OK"})
+	modal.SetDoneFunc(func(_ int, label string) {
+		client.App.SetRoot(client.GridLayout, true).SetFocus(client.PageView.PageText)
+		client.active_view = client.PageView.PageText
+		if label == "Retry" {
+			retry()
+		}
+	})
+	client.App.SetRoot(modal, true).SetFocus(modal)
+	client.active_view = modal
 }
 
-func (c *Client) CommandBack() {
-	c.SaveScroll()
-	prev_page := c.HistoryManager.Back()
-	if prev_page != nil {
-		c.PageView.RenderPage(prev_page)
+// Animate a spinner in the status line, with the number of bytes counted in
+// received so far, until the returned function is called. It must be called
+// from the UI goroutine, like in QueueUpdateDraw.
+func (client *Client) startSpinner(received *int64) func() {
+	// Only the latest load's progress is shown
+	if client.stopSpinner != nil {
+		client.stopSpinner()
+	}
+	client.PageView.Loading = "Loading"
+	client.PageView.UpdateStatus()
+	stopped := false
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(SPINNER_INTERVAL)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			status := fmt.Sprintf("%c Loading", SPINNER_FRAMES[frame%len(SPINNER_FRAMES)])
+			if n_bytes := atomic.LoadInt64(received); n_bytes > 0 {
+				status += " " + core.FormatByteCount(n_bytes)
+			}
+			client.App.QueueUpdateDraw(func() {
+				// Updates queued before the spinner stopped
+				if stopped {
+					return
+				}
+				client.PageView.Loading = status
+				client.PageView.UpdateStatus()
+			})
+		}
+	}()
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		close(done)
+		client.PageView.Loading = ""
+		client.PageView.UpdateStatus()
+	}
+	client.stopSpinner = stop
+	return stop
+}
+
+// Ask for a search term, then search the gopher query selector at query_url
+func (client *Client) PromptGopherQuery(query_url string) {
+	client.BuildCommandLine("Query: ", func(commandLine *tview.InputField, key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		link := &core.Link{Type: core.GopherQuery, Url: query_url}
+		search_url, err := core.GopherQueryUrl(link, commandLine.GetText())
+		if err != nil {
+			AppLog.Error(err)
+			return
+		}
+		client.GotoUrl(search_url)
+	})
+}
+
+// Whether _url is a web link, opened in the browser. Gopher html items that
+// aren't "URL:" links to the web are fetched from the gopher server instead.
+func isWebUrl(_url string) bool {
+	parsed_url, err := url.Parse(_url)
+	return err == nil && (parsed_url.Scheme == "http" || parsed_url.Scheme == "https")
+}
+
+// Open a web link in the external browser, asking first if confirm_browser
+// is set. With the browser turned off by toggle-external, the url is only
+// shown.
+func (client *Client) OpenInBrowser(url string) {
+	if client.externalDisabled {
+		AppLog.Infof("External link: %s", url)
+		return
+	}
+	if !client.config.ConfirmBrowser {
+		client.launchBrowser(url)
+		return
+	}
+	client.BuildCommandLine(fmt.Sprintf("Open %s in browser? (y/n) ", url), func(commandLine *tview.InputField, key tcell.Key) {
+		answer := strings.ToLower(strings.TrimSpace(commandLine.GetText()))
+		if key == tcell.KeyEnter && (answer == "y" || answer == "yes") {
+			client.launchBrowser(url)
+		}
+	})
+}
+
+// Start the browser command with url in place of %s, or after it if the
+// command has no %s. The browser isn't waited for.
+func (client *Client) launchBrowser(url string) {
+	browser := strings.Fields(client.config.ExternalBrowser)
+	if len(browser) == 0 {
+		AppLog.Error("No browser configured")
+		return
+	}
+	has_placeholder := false
+	for i, arg := range browser {
+		if strings.Contains(arg, "%s") {
+			browser[i] = strings.ReplaceAll(arg, "%s", url)
+			has_placeholder = true
+		}
+	}
+	if !has_placeholder {
+		browser = append(browser, url)
+	}
+	cmd := exec.Command(browser[0], browser[1:]...)
+	if err := cmd.Start(); err != nil {
+		AppLog.Errorf("Failed to open %s in \"%s\": %v", url, client.config.ExternalBrowser, err)
+		return
+	}
+	AppLog.Infof("Opened %s in %s", url, browser[0])
+	go cmd.Wait()
+}
+
+// Turn opening web links in the external browser off or back on for
+// this session
+func (client *Client) CommandToggleExternal() {
+	client.externalDisabled = !client.externalDisabled
+	if client.externalDisabled {
+		AppLog.Info("Web links will only be shown")
+	} else {
+		AppLog.Info("Web links will open in the browser")
+	}
+}
+
+// Run the program argv[0] with the rest of argv as its arguments, giving it
+// the terminal until it exits. It reads its input from stdin.
+func (client *Client) runInTerminal(argv []string, stdin io.Reader) error {
+	var err error
+	client.App.Suspend(func() {
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.Stdin = stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+	})
+	return err
+}
+
+// Write an email to the address of a mailto url with the configured mail
+// client. Without one, the address is shown so it can be copied.
+func (client *Client) OpenMailClient(mailto_url string) {
+	mail_client := strings.Fields(client.config.EmailClient)
+	if len(mail_client) == 0 {
+		address := strings.SplitN(strings.TrimPrefix(mailto_url, "mailto:"), "?", 2)[0]
+		if unescaped, err := url.PathUnescape(address); err == nil {
+			address = unescaped
+		}
+		AppLog.Infof("Email address: %s", address)
+		return
+	}
+	// Mail clients usually run in the terminal, like the pager
+	err := client.runInTerminal(append(mail_client, mailto_url), os.Stdin)
+	if err != nil {
+		AppLog.Errorf("Failed to run mail client \"%s\": %v", client.config.EmailClient, err)
+	}
+}
+
+// Show a page that was generated locally instead of fetched from a url
+func (client *Client) ShowPage(page *core.Page) {
+	client.SaveScroll()
+	client.stopAutoreload()
+	client.PageView.RenderPage(page)
+	client.HistoryManager.Navigate(page)
+	client.UpdateTabBar()
+}
+
+func (client *Client) SaveScroll() {
+	page := client.HistoryManager.CurrentPage()
+	if page != nil {
+		row, _ := client.PageView.PageText.GetScrollOffset()
+		page.ScrollOffset = row
+	}
+}
+
+func (c *Client) PageInputHandler(event *tcell.EventKey) *tcell.EventKey {
+	c.MessageLine.Clear()
+	if c.PageView.Selecting {
+		return c.visualInputHandler(event)
+	}
+	key_name := string(event.Rune())
+	if event.Key() != tcell.KeyRune {
+		key_name = tcell.KeyNames[event.Key()]
+	}
+	// Digits typed before any other key are a count for it
+	is_digit := event.Key() == tcell.KeyRune && event.Rune() >= '0' && event.Rune() <= '9'
+	if !is_digit {
+		if count := c.takeCount(); count > 0 {
+			c.count = count
+		}
+	}
+	if c.keyPrefixTimer != nil {
+		c.keyPrefixTimer.Stop()
+		c.keyPrefixTimer = nil
+		sequence := c.keyPrefix + key_name
+		c.keyPrefix = ""
+		if c.runBinding(sequence) {
+			return nil
+		}
+	} else if c.isKeySequencePrefix(key_name) {
+		c.startKeySequence(key_name)
+		return nil
+	}
+	if c.runBinding(key_name) {
+		return nil
+	}
+	c.count = 0
+
+	// Bind number keys to quick select links
+	if is_digit {
+		c.selectLinkDigit(event.Rune())
+	} else if event.Key() == tcell.KeyRune && !c.config.QuietUnboundKeys &&
+		!strings.ContainsRune(TEXTVIEW_KEYS, event.Rune()) {
+		c.showUnboundKey(key_name)
+	}
+	return event
+}
+
+// Tell the user that key does nothing, and how to find out what does
+func (c *Client) showUnboundKey(key string) {
+	var help_keys []string
+	for binding, command := range c.keyBindings {
+		if command == "help" {
+			help_keys = append(help_keys, binding)
+		}
+	}
+	help := "run :help"
+	if len(help_keys) > 0 {
+		sort.Strings(help_keys)
+		help = "press " + help_keys[0]
+	}
+	fmt.Fprintf(c.MessageLine, "Unbound key '%s', %s for help", tview.Escape(key), tview.Escape(help))
+}
+
+// Run the command bound to key, which may be a key sequence.
+// Returns false if nothing is bound to it.
+func (c *Client) runBinding(key string) bool {
+	// Keys can be unbound in the config by binding them to ""
+	binding, is_bound := c.keyBindings[key]
+	if !is_bound || binding == "" {
+		return false
+	}
+	count := c.count
+	c.count = 0
+	if count_func, is_count_cmd := c.commandNameToCountFunc[binding]; is_count_cmd && count > 0 {
+		count_func(count)
+		return true
+	}
+	if cmd_func, is_cmd := c.commandNameToFunc[binding]; is_cmd {
+		cmd_func()
+		return true
+	}
+	if args_func, is_args_cmd := c.commandNameToArgsFunc[binding]; is_args_cmd {
+		args_func(nil)
+		return true
+	}
+	AppLog.Errorf("Not a valid command: \"%s\"", binding)
+	return false
+}
+
+// Wait for the second key of a sequence starting with key. If none comes
+// within KEY_SEQUENCE_TIMEOUT, key is handled on its own.
+func (c *Client) startKeySequence(key string) {
+	c.keyPrefix = key
+	var timer *time.Timer
+	timer = time.AfterFunc(KEY_SEQUENCE_TIMEOUT, func() {
+		c.App.QueueUpdateDraw(func() {
+			// A newer key replaced this timer
+			if timer != c.keyPrefixTimer {
+				return
+			}
+			c.keyPrefix = ""
+			c.keyPrefixTimer = nil
+			if !c.runBinding(key) && len(key) == 1 && key[0] >= '0' && key[0] <= '9' {
+				c.selectLinkDigit(rune(key[0]))
+			}
+		})
+	})
+	c.keyPrefixTimer = timer
+}
+
+// Whether key is the first key of a bound two key sequence
+func (c *Client) isKeySequencePrefix(key string) bool {
+	for binding, command := range c.keyBindings {
+		if first, _, ok := splitKeySequence(binding); ok && first == key && command != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Split a binding like "gg" or "Ctrl-Wj" into its two keys. Returns false
+// for bindings of a single key.
+func splitKeySequence(binding string) (string, string, bool) {
+	if isKeyName(binding) {
+		return "", "", false
+	}
+	for i := range binding {
+		if i > 0 && isKeyName(binding[:i]) && isKeyName(binding[i:]) {
+			return binding[:i], binding[i:], true
+		}
+	}
+	return "", "", false
+}
+
+// Whether name is a single character or the name tcell gives a special key
+func isKeyName(name string) bool {
+	if utf8.RuneCountInString(name) == 1 {
+		return true
+	}
+	for _, key_name := range tcell.KeyNames {
+		if key_name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a typed digit to the number of the link to follow. The link is followed
+// when no other digit is typed within LINK_DIGIT_TIMEOUT, so links past the
+// ninth can be selected too. A scroll key typed before then takes the digits
+// as its count instead, see takeCount.
+func (c *Client) selectLinkDigit(digit rune) {
+	if c.linkDigitsTimer != nil {
+		c.linkDigitsTimer.Stop()
+		c.linkDigitsTimer = nil
+	}
+	if c.linkDigits == "" && digit == '0' {
+		return
+	}
+	c.linkDigits += string(digit)
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		c.linkDigits = ""
+		return
+	}
+	link_num, _ := strconv.Atoi(c.linkDigits)
+	var timer *time.Timer
+	timer = time.AfterFunc(LINK_DIGIT_TIMEOUT, func() {
+		c.App.QueueUpdateDraw(func() {
+			// A newer digit replaced this timer
+			if timer != c.linkDigitsTimer {
+				return
+			}
+			c.linkDigits = ""
+			c.linkDigitsTimer = nil
+			if page == c.HistoryManager.CurrentPage() {
+				c.FollowLink(page, link_num)
+			}
+		})
+	})
+	c.linkDigitsTimer = timer
+}
+
+// Stop waiting for more digits of a link number and return the number
+// typed so far, 0 if none
+func (c *Client) takeCount() int {
+	if c.linkDigitsTimer == nil {
+		return 0
+	}
+	c.linkDigitsTimer.Stop()
+	c.linkDigitsTimer = nil
+	count, _ := strconv.Atoi(c.linkDigits)
+	c.linkDigits = ""
+	return count
+}
+
+func (c *Client) FollowLink(page *core.Page, link_num int) {
+	if link_num > 0 && int(link_num) <= len(page.Links) {
+		link := page.Links[link_num-1]
+		if link.Type == core.GopherQuery {
+			c.PromptGopherQuery(link.Url)
+		} else if strings.HasPrefix(link.Url, "mailto:") {
+			c.OpenMailClient(link.Url)
+		} else if isWebUrl(link.Url) {
+			c.OpenInBrowser(link.Url)
+			return
+		} else {
+			c.gotoLink(link.Url, page, link_num)
+		}
+	} else {
+		AppLog.Errorf("No link #%d on the current page", link_num)
+	}
+}
+
+// Ask for a link number and follow that link on the current page
+func (c *Client) CommandFollow() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to follow links on")
+		return
+	}
+	c.BuildCommandLine("Link #: ", func(commandLine *tview.InputField, key tcell.Key) {
+		if key != tcell.KeyEnter || commandLine.GetText() == "" {
+			return
+		}
+		link_num, err := strconv.Atoi(strings.TrimSpace(commandLine.GetText()))
+		if err != nil {
+			AppLog.Errorf("Not a link number: \"%s\"", commandLine.GetText())
+			return
+		}
+		c.FollowLink(page, link_num)
+	})
+}
+
+func (c *Client) CommandCmdPrompt() {
+	c.BuildCommandPrompt(": ", "")
+}
+
+// Open the command line prefilled with the current url for editing
+func (c *Client) CommandOpenUrl() {
+	current_url := ""
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		current_url = page.Url
+	}
+	c.BuildCommandPrompt("Open: ", current_url)
+}
+
+// Open the command line prefilled with the selector of the current url, and
+// go to the same server with the edited selector. The item type is kept,
+// unless the selector now ends in a slash, which is taken as a directory.
+// Urls of other schemes have their path edited.
+func (c *Client) CommandEditSelector() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to edit the selector of")
+		return
+	}
+	parsed_url, err := url.Parse(page.Url)
+	if err != nil {
+		AppLog.Error(err)
+		return
+	}
+	if parsed_url.Scheme != "gopher" && parsed_url.Scheme != "gophers" {
+		c.buildCommandLine("Selector: ", parsed_url.Path, false, nil, func(commandLine *tview.InputField, key tcell.Key) {
+			if key != tcell.KeyEnter {
+				return
+			}
+			new_url := *parsed_url
+			new_url.RawQuery = ""
+			new_url.Fragment = ""
+			new_url.Path = commandLine.GetText()
+			c.GotoUrl(new_url.String())
+		})
+		return
+	}
+	item_type, selector, search_term := core.SplitGopherUrl(parsed_url)
+	c.buildCommandLine("Selector: ", selector, false, nil, func(commandLine *tview.InputField, key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		new_selector := commandLine.GetText()
+		if new_selector == "" || strings.HasSuffix(new_selector, "/") || item_type == 0 {
+			item_type = '1'
+		}
+		if search_term == "" {
+			c.GotoUrl(core.JoinGopherUrl(parsed_url.Scheme, parsed_url.Host, item_type, new_selector, ""))
+			return
+		}
+		// Search results can be edited into a different search too
+		c.buildCommandLine("Search: ", search_term, false, nil, func(commandLine *tview.InputField, key tcell.Key) {
+			if key == tcell.KeyEnter {
+				c.GotoUrl(core.JoinGopherUrl(parsed_url.Scheme, parsed_url.Host, item_type,
+					new_selector, commandLine.GetText()))
+			}
+		})
+	})
+}
+
+// Dispatch a line entered in the command line. It can be a command name,
+// a link number on the current page, or a url.
+func (c *Client) RunCommand(commandString string) {
+	fields := strings.Fields(commandString)
+	if len(fields) == 0 {
+		return
+	}
+	cmd := fields[0]
+	if alias_url, is_alias := c.config.Aliases[cmd]; is_alias && len(fields) == 1 {
+		c.GotoUrl(alias_url)
+		return
+	}
+	cmd_func, in_cmd_map := c.commandNameToFunc[cmd]
+	args_func, in_args_cmd_map := c.commandNameToArgsFunc[cmd]
+	if in_cmd_map {
+		cmd_func()
+	} else if in_args_cmd_map {
+		args_func(fields[1:])
+	} else {
+		if link_num, err := strconv.ParseInt(cmd, 10, 32); err == nil {
+			current_page := c.HistoryManager.CurrentPage()
+			c.FollowLink(current_page, int(link_num))
+		} else if len(fields) == 1 && looksLikeHost(cmd) {
+			c.GotoUrl(c.config.DefaultScheme + "://" + cmd)
+		} else if url, err := url.Parse(commandString); err == nil && url.Scheme != "" {
+			switch url.Scheme {
+			case "gopher", "gophers", "gemini", "spartan", "finger", "file":
+				c.GotoUrl(commandString)
+			case "http", "https":
+				c.OpenInBrowser(commandString)
+			case "mailto":
+				c.OpenMailClient(commandString)
+			default:
+				AppLog.Errorf("Protocol \"%s\" not supported", url.Scheme)
+			}
+		} else {
+			AppLog.Errorf("Not a valid command: \"%s\"", cmd)
+		}
+	}
+}
+
+// Whether text is a host name without a scheme, like "gopher.floodgap.com"
+// or "localhost:7070/1/docs", rather than a command
+func looksLikeHost(text string) bool {
+	if strings.Contains(text, "://") {
+		return false
+	}
+	host := text
+	if slash := strings.Index(host, "/"); slash >= 0 {
+		host = host[:slash]
+	}
+	if colon := strings.LastIndex(host, ":"); colon >= 0 {
+		if _, err := strconv.Atoi(host[colon+1:]); err != nil {
+			return false
+		}
+		host = host[:colon]
+	}
+	if host != "localhost" && !strings.Contains(strings.Trim(host, "."), ".") {
+		return false
+	}
+	// Numbers like "1.2" are only hosts as whole IPv4 addresses
+	if strings.Trim(host, "0123456789.") == "" && net.ParseIP(host) == nil {
+		return false
+	}
+	for _, char := range host {
+		if !(char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' ||
+			char >= '0' && char <= '9' || char == '.' || char == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Scroll down by lines, or up if lines is negative
+func (c *Client) scrollLines(lines int) {
+	curr_row, curr_col := c.PageView.PageText.GetScrollOffset()
+	scrollDest := curr_row + lines
+	bottom := c.PageView.NumLines()
+	if scrollDest >= bottom {
+		scrollDest = bottom
+	}
+	if scrollDest <= 0 {
+		scrollDest = 0
+	}
+	c.PageView.PageText.ScrollTo(scrollDest, curr_col)
+	c.PageView.UpdateStatus()
+}
+
+func (c *Client) CommandScrollUp() {
+	c.scrollLines(-c.config.ScrollLines)
+}
+
+func (c *Client) CommandScrollDown() {
+	c.scrollLines(c.config.ScrollLines)
+}
+
+func (c *Client) CommandScrollTop() {
+	c.PageView.PageText.ScrollToBeginning()
+	c.PageView.UpdateStatus()
+}
+
+func (c *Client) CommandScrollBottom() {
+	c.PageView.PageText.ScrollToEnd()
+	c.PageView.UpdateStatus()
+}
+
+// Lines moved by the half page scroll commands, half the view's height
+// unless the config gives a fixed number
+func (c *Client) halfPageLines() int {
+	if c.config.HalfPageLines > 0 {
+		return c.config.HalfPageLines
+	}
+	_, _, _, height := c.PageView.PageText.GetRect()
+	return height / 2
+}
+
+func (c *Client) CommandScrollHalfDown() {
+	c.scrollLines(c.halfPageLines())
+}
+
+func (c *Client) CommandScrollHalfUp() {
+	c.scrollLines(-c.halfPageLines())
+}
+
+// Scroll the page so the next link below the top of the view is at the top,
+// or the previous one above it if step is negative
+func (c *Client) scrollToLink(step int) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil || len(page.LinkLines) == 0 {
+		AppLog.Info("No links on this page")
+		return
+	}
+	rows := c.PageView.LineRows()
+	curr_row, curr_col := c.PageView.PageText.GetScrollOffset()
+	for i := range page.LinkLines {
+		if step < 0 {
+			i = len(page.LinkLines) - 1 - i
+		}
+		line := page.LinkLines[i]
+		if line >= len(rows) {
+			continue
+		}
+		if (step > 0 && rows[line] > curr_row) || (step < 0 && rows[line] < curr_row) {
+			c.PageView.PageText.ScrollTo(rows[line], curr_col)
+			c.PageView.UpdateStatus()
+			return
+		}
+	}
+	if step > 0 {
+		AppLog.Info("No more links below")
+	} else {
+		AppLog.Info("No more links above")
+	}
+}
+
+func (c *Client) CommandLinkNext() {
+	c.scrollToLink(1)
+}
+
+func (c *Client) CommandLinkPrev() {
+	c.scrollToLink(-1)
+}
+
+// Scroll sideways by SCROLL_COLUMNS, only possible when wrapping is off
+func (c *Client) scrollColumns(columns int) {
+	if c.PageView.textWraps() {
+		AppLog.Info("Turn off wrapping with the wrap command to scroll sideways")
+		return
+	}
+	curr_row, curr_col := c.PageView.PageText.GetScrollOffset()
+	scrollDest := curr_col + columns
+	if scrollDest <= 0 {
+		scrollDest = 0
+	}
+	c.PageView.PageText.ScrollTo(curr_row, scrollDest)
+}
+
+func (c *Client) CommandScrollLeft() {
+	c.scrollColumns(-SCROLL_COLUMNS)
+}
+
+func (c *Client) CommandScrollRight() {
+	c.scrollColumns(SCROLL_COLUMNS)
+}
+
+func (c *Client) CommandBack() {
+	c.SaveScroll()
+	prev_page := c.HistoryManager.Back()
+	if prev_page != nil {
+		c.stopAutoreload()
+		c.PageView.RenderPage(prev_page)
+		c.UpdateTabBar()
 	} else {
 		AppLog.Info("Already at first page")
 	}
@@ -416,12 +1780,435 @@ func (c *Client) CommandForward() {
 	c.SaveScroll()
 	next_page := c.HistoryManager.Forward()
 	if next_page != nil {
+		c.stopAutoreload()
 		c.PageView.RenderPage(next_page)
+		c.UpdateTabBar()
 	} else {
 		AppLog.Info("Already at last page")
 	}
 }
 
+// Redraw the tab bar with the title of each tab's current page
+func (c *Client) UpdateTabBar() {
+	c.TabBar.Clear()
+	for i, tab := range c.Tabs {
+		title := "(loading)"
+		if tab.restore_url != "" {
+			title = tab.restore_url
+		}
+		if page := tab.CurrentPage(); page != nil {
+			title = page.Title
+			if title == "" {
+				title = page.Url
+			}
+		}
+		if title_runes := []rune(title); len(title_runes) > TAB_TITLE_WIDTH {
+			title = string(title_runes[:TAB_TITLE_WIDTH-1]) + "…"
+		}
+		if i == c.activeTab {
+			fmt.Fprintf(c.TabBar, "[black:white] %d: %s [-:-]", i+1, tview.Escape(title))
+		} else {
+			fmt.Fprintf(c.TabBar, " %d: %s ", i+1, tview.Escape(title))
+		}
+	}
+}
+
+// Make the tab at index the active one and show its current page
+func (c *Client) SwitchTab(index int) {
+	c.SaveScroll()
+	c.stopAutoreload()
+	c.activeTab = index
+	c.HistoryManager = c.Tabs[index]
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		c.PageView.RenderPage(page)
+	} else {
+		c.PageView.Clear()
+	}
+	if restore_url := c.HistoryManager.restore_url; restore_url != "" {
+		c.HistoryManager.restore_url = ""
+		c.GotoUrl(restore_url)
+	}
+	c.UpdateTabBar()
+}
+
+// Fetch the current page again, bypassing the cache. The history entry is
+// updated in place and keeps its scroll position.
+func (c *Client) CommandReload() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to reload")
+		return
+	}
+	c.SaveScroll()
+	history := c.HistoryManager
+	config := c.fetchConfig()
+	seq, ctx, cancel := history.startLoad()
+	stopSpinner := c.startSpinner(config.Received)
+	go func() {
+		defer cancel()
+		c.loadingLock.Lock()
+		defer c.loadingLock.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		new_page, err := core.FetchContext(ctx, config, page.Url)
+		if ctx.Err() != nil {
+			AppLog.Debugf("Reload of %s replaced by a newer load", page.Url)
+			return
+		}
+		if err != nil {
+			AppLog.Errorf("Failed to reload %s: %v", page.Url, err)
+		} else if new_page != nil {
+			c.App.QueueUpdateDraw(func() {
+				if seq != history.load_seq {
+					return
+				}
+				page.Type = new_page.Type
+				page.Title = new_page.Title
+				page.Content = new_page.Content
+				page.Raw = new_page.Raw
+				page.Links = new_page.Links
+				page.Image = new_page.Image
+				c.Cache.Put(page)
+				if page == c.HistoryManager.CurrentPage() {
+					c.PageView.RenderPage(page)
+				}
+				c.UpdateTabBar()
+				c.MessageLine.Clear()
+			})
+		}
+		c.App.QueueUpdateDraw(stopSpinner)
+	}()
+}
+
+// Reload the current page every args[0] seconds until another page is
+// shown, or stop with 0
+func (c *Client) CommandAutoreload(args []string) {
+	if len(args) == 0 {
+		AppLog.Error("Usage: autoreload <seconds>")
+		return
+	}
+	seconds, err := strconv.Atoi(args[0])
+	if err != nil || seconds < 0 {
+		AppLog.Errorf("Not a number of seconds: %s", args[0])
+		return
+	}
+	c.stopAutoreload()
+	if seconds == 0 {
+		AppLog.Info("Autoreload stopped")
+		return
+	}
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to reload")
+		return
+	}
+	interval := time.Duration(seconds) * time.Second
+	c.autoreloadPage = page
+	c.PageView.AutoreloadUrl = page.Url
+	c.PageView.AutoreloadInterval = interval
+	c.PageView.UpdateStatus()
+	c.scheduleAutoreload(interval)
+}
+
+// Reload the autoreload page after interval, and again after that, as long
+// as it is still the page being shown
+func (c *Client) scheduleAutoreload(interval time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(interval, func() {
+		c.App.QueueUpdateDraw(func() {
+			// Autoreload was stopped or restarted since
+			if timer != c.autoreloadTimer {
+				return
+			}
+			if c.HistoryManager.CurrentPage() != c.autoreloadPage {
+				c.stopAutoreload()
+				return
+			}
+			c.CommandReload()
+			c.scheduleAutoreload(interval)
+		})
+	})
+	c.autoreloadTimer = timer
+}
+
+func (c *Client) stopAutoreload() {
+	if c.autoreloadTimer != nil {
+		c.autoreloadTimer.Stop()
+		c.autoreloadTimer = nil
+	}
+	c.autoreloadPage = nil
+	c.PageView.AutoreloadUrl = ""
+	c.PageView.UpdateStatus()
+}
+
+func (c *Client) CommandToggleLineNumbers() {
+	c.PageView.LineNumbers = !c.PageView.LineNumbers
+	c.SaveScroll()
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		c.PageView.RenderPage(page)
+	}
+}
+
+// Show or hide the numbers of gopher directory items. Typing a number still
+// follows the item it would have shown.
+func (c *Client) CommandToggleLinkNumbers() {
+	c.PageView.HideLinkNumbers = !c.PageView.HideLinkNumbers
+	c.SaveScroll()
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		c.PageView.RenderPage(page)
+	}
+}
+
+// Read the current page's content in the external pager, taking over the
+// terminal until it exits
+func (c *Client) CommandPager() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to show")
+		return
+	}
+	pager := strings.Fields(c.config.Pager)
+	if len(pager) == 0 {
+		AppLog.Error("No pager configured")
+		return
+	}
+	err := c.runInTerminal(pager, strings.NewReader(page.Content))
+	if err != nil {
+		AppLog.Errorf("Failed to run pager \"%s\": %v", c.config.Pager, err)
+	}
+}
+
+// Open the log file in $EDITOR, taking over the terminal until it exits.
+// The file has the full log, with debug messages the log view leaves out.
+func (c *Client) CommandEditLog() {
+	if c.logPath == "" {
+		AppLog.Error("Not logging to a file")
+		return
+	}
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{DEFAULT_EDITOR}
+	}
+	err := c.runInTerminal(append(editor, c.logPath), os.Stdin)
+	if err != nil {
+		AppLog.Errorf("Failed to run editor \"%s\": %v", editor[0], err)
+	}
+}
+
+// Switch between the rendered page and its content exactly as received
+func (c *Client) CommandToggleRaw() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to show")
+		return
+	}
+	c.SaveScroll()
+	if c.PageView.Raw {
+		c.PageView.RenderFormatted(page)
+	} else {
+		c.PageView.RenderRaw(page)
+	}
+}
+
+// Show every directory and gemtext page as received, like the raw command,
+// until this is run again
+func (c *Client) CommandRawMode() {
+	c.PageView.RawMode = !c.PageView.RawMode
+	c.SaveScroll()
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		c.PageView.RenderPage(page)
+	}
+	if c.PageView.RawMode {
+		AppLog.Info("Raw mode on, pages are shown as received")
+	} else {
+		AppLog.Info("Raw mode off")
+	}
+}
+
+// Read the config file again and apply it. If the file is missing or has an
+// error the current config is kept. The cache keeps its size until restarted, since
+// pages are still being added to it from loading goroutines.
+func (c *Client) CommandReloadConfig() {
+	config, err := parseConfig(c.configPath)
+	if err != nil {
+		AppLog.Errorf("%v\nKeeping the current config", err)
+		return
+	}
+	c.config = config
+	c.keyBindings = mergeKeyBindings(config.Bindings)
+	c.PageView.LineNumbers = config.LineNumbers
+	c.PageView.HideLinkNumbers = config.HideLinkNumbers
+	c.PageView.Highlight = config.Highlight
+	c.PageView.DetectInfoLinks = config.DetectInfoLinks
+	c.PageView.ImageProtocol = resolveImageProtocol(config.ImageProtocol)
+	c.PageView.SetTheme(config.Theme)
+	c.SaveScroll()
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		c.PageView.RenderPage(page)
+	}
+	AppLog.Infof("Reloaded config from %s", c.configPath)
+}
+
+// Switch between wrapping long lines and scrolling them horizontally
+func (c *Client) CommandToggleWrap() {
+	c.PageView.SetWrap(!c.PageView.Wrap)
+	c.SaveScroll()
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		c.PageView.RenderPage(page)
+	}
+}
+
+// Add margins on both sides of the page when the screen is wider than
+// config.MaxWidth, so the page is centered in that many columns
+func (c *Client) layoutMargins(width int) {
+	margin := 0
+	if c.config.MaxWidth > 0 && width > c.config.MaxWidth {
+		margin = (width - c.config.MaxWidth) / 2
+	}
+	if margin == c.pageMargin {
+		return
+	}
+	c.pageMargin = margin
+	c.GridLayout.RemoveItem(c.PageView.PageText)
+	if margin > 0 {
+		c.GridLayout.SetColumns(margin, 0, margin)
+		c.GridLayout.AddItem(c.PageView.PageText, 0, 1, 1, 1, 0, 0, true)
+	} else {
+		c.GridLayout.SetColumns(0)
+		c.GridLayout.AddItem(c.PageView.PageText, 0, 0, 1, GRID_COLUMNS, 0, 0, true)
+	}
+}
+
+// Fit the status line to a new screen size, and render the page again if
+// it was laid out for the old width. Other text is rewrapped by the TextView.
+func (c *Client) resized() {
+	c.PageView.UpdateStatus()
+	page := c.HistoryManager.CurrentPage()
+	if page == nil || c.PageView.Raw {
+		return
+	}
+	if page.Type == core.ImageType || page.Type == core.GemtextType ||
+		(page.Type == core.TextType && c.PageView.LineNumbers) {
+		c.SaveScroll()
+		c.PageView.RenderPage(page)
+	}
+}
+
+// Change the width the page is centered in by columns
+func (c *Client) changeMaxWidth(columns int) {
+	_, _, width, _ := c.GridLayout.GetRect()
+	max_width := c.config.MaxWidth
+	if max_width == 0 || max_width > width {
+		max_width = width
+	}
+	max_width += columns
+	if max_width < MIN_PAGE_WIDTH {
+		max_width = MIN_PAGE_WIDTH
+	}
+	if max_width >= width {
+		max_width = 0
+	}
+	c.config.MaxWidth = max_width
+	c.layoutMargins(width)
+	c.App.QueueUpdateDraw(c.resized)
+	// Kept for the next session, and for reload-config
+	if err := saveMaxWidth(c.configPath, max_width); err != nil {
+		AppLog.Errorf("Failed to save max_width to \"%s\"\n\t%v", c.configPath, err)
+	}
+}
+
+// Make the margins wider, so the page is narrower
+func (c *Client) CommandMarginWider() {
+	c.changeMaxWidth(-2 * MARGIN_STEP)
+}
+
+// Make the margins narrower, so the page is wider
+func (c *Client) CommandMarginNarrower() {
+	c.changeMaxWidth(2 * MARGIN_STEP)
+}
+
+// Open a new tab on the home page
+func (c *Client) CommandTabNew() {
+	c.Tabs = append(c.Tabs, &HistoryManager{})
+	c.SwitchTab(len(c.Tabs) - 1)
+	c.GotoUrl(c.config.HomePage)
+}
+
+// Open link number args[0] of the current page in a new tab in the
+// background, without leaving the current one
+func (c *Client) CommandTabFollow(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil || len(args) == 0 {
+		AppLog.Error("Usage: tab-follow <link number>")
+		return
+	}
+	link_num, err := strconv.Atoi(args[0])
+	if err != nil || link_num < 1 || link_num > len(page.Links) {
+		AppLog.Errorf("No link #%s on the current page", args[0])
+		return
+	}
+	link := page.Links[link_num-1]
+	// Searches need input and web links open elsewhere anyway
+	if link.Type == core.GopherQuery || isWebUrl(link.Url) || core.GopherQueryNeedsInput(link.Url) ||
+		strings.HasPrefix(link.Url, "mailto:") {
+		c.FollowLink(page, link_num)
+		return
+	}
+	tab := &HistoryManager{}
+	c.Tabs = append(c.Tabs, tab)
+	c.UpdateTabBar()
+	link_url, anchor := splitUrlAnchor(link.Url)
+	c.loadPage(tab, link_url, anchor, page, link_num)
+}
+
+func (c *Client) CommandTabNext() {
+	c.SwitchTab((c.activeTab + 1) % len(c.Tabs))
+}
+
+func (c *Client) CommandTabPrev() {
+	c.SwitchTab((c.activeTab - 1 + len(c.Tabs)) % len(c.Tabs))
+}
+
+func (c *Client) CommandTabClose() {
+	if len(c.Tabs) == 1 {
+		AppLog.Error("Can't close the last tab")
+		return
+	}
+	c.Tabs[c.activeTab].closed_index = c.activeTab
+	c.closedTabs = append(c.closedTabs, c.Tabs[c.activeTab])
+	c.Tabs = append(c.Tabs[:c.activeTab], c.Tabs[c.activeTab+1:]...)
+	index := c.activeTab
+	if index >= len(c.Tabs) {
+		index = len(c.Tabs) - 1
+	}
+	c.SwitchTab(index)
+}
+
+// Bring back the most recently closed tab where it was. If no tabs were
+// closed, go to the page most recently dropped from this tab's forward
+// history.
+func (c *Client) CommandReopen() {
+	if n_closed := len(c.closedTabs); n_closed > 0 {
+		tab := c.closedTabs[n_closed-1]
+		c.closedTabs = c.closedTabs[:n_closed-1]
+		index := tab.closed_index
+		if index > len(c.Tabs) {
+			index = len(c.Tabs)
+		}
+		c.Tabs = append(c.Tabs, nil)
+		copy(c.Tabs[index+1:], c.Tabs[index:])
+		c.Tabs[index] = tab
+		c.SwitchTab(index)
+		return
+	}
+	if page := c.HistoryManager.PopDropped(); page != nil {
+		c.ShowPage(page)
+		return
+	}
+	AppLog.Info("Nothing to reopen")
+}
+
 func (c *Client) CommandViewLogs() {
 	logView := tview.NewTextView().
 		SetChangedFunc(func() {
@@ -439,9 +2226,295 @@ func (c *Client) CommandViewLogs() {
 		}
 		return event
 	})
-	fmt.Fprintf(tview.ANSIWriter(logView), c.LogBuffer.String())
-	c.App.SetRoot(logView, true).SetFocus(logView)
-	c.active_view = logView
+	fmt.Fprintf(tview.ANSIWriter(logView), c.LogBuffer.String())
+	c.App.SetRoot(logView, true).SetFocus(logView)
+	c.active_view = logView
+}
+
+// Show every command and the keys currently bound to it
+func (c *Client) CommandHelp() {
+	command_keys := make(map[string][]string)
+	for key, command := range c.keyBindings {
+		command_keys[command] = append(command_keys[command], key)
+	}
+	var commands []string
+	for command := range c.commandNameToFunc {
+		commands = append(commands, command)
+	}
+	for command := range c.commandNameToArgsFunc {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	helpView := tview.NewTextView()
+	helpView.SetBorder(true)
+	helpView.SetTitle("Commands")
+	helpView.SetDynamicColors(true)
+	helpView.SetBackgroundColor(tcell.ColorDefault)
+	helpView.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Rune() == '?' || event.Key() == tcell.KeyEscape {
+			c.App.SetRoot(c.GridLayout, true).SetFocus(c.PageView.PageText)
+			c.active_view = c.PageView.PageText
+			return nil
+		}
+		return event
+	})
+	for _, command := range commands {
+		keys := command_keys[command]
+		sort.Strings(keys)
+		fmt.Fprintf(helpView, "[green]%-20s[white] %s\n", command, tview.Escape(strings.Join(keys, " ")))
+	}
+	c.App.SetRoot(helpView, true).SetFocus(helpView)
+	c.active_view = helpView
+}
+
+// Show the pages in the current tab's history as a page of links, most
+// recent first. It is shown over the current page rather than added to the
+// history, and following a link jumps to that page without dropping the
+// pages after it.
+func (c *Client) CommandHistory() {
+	history := c.HistoryManager
+	if len(history.page_history) == 0 {
+		AppLog.Info("History is empty")
+		return
+	}
+	c.SaveScroll()
+	c.stopAutoreload()
+	page := historyPage(history)
+	history.ShowOverlay(page)
+	c.PageView.RenderPage(page)
+	c.UpdateTabBar()
+}
+
+// Build a gopher directory page linking to every page in the history, like
+// the bookmarks page. The current page is marked with a *.
+func historyPage(history *HistoryManager) *core.Page {
+	dir := gopher.Directory{}
+	var links []*core.Link
+	for i := len(history.page_history) - 1; i >= 0; i-- {
+		page := history.page_history[i]
+		description := page.Title
+		if description == "" {
+			description = page.Url
+		}
+		if i == history.history_index {
+			description = "* " + description
+		}
+		entry_url := fmt.Sprintf("%s%s%d", HISTORY_URL, HISTORY_INDEX_QUERY, i)
+		item_type := core.UrlItemType(page.Url)
+		dir.Items = append(dir.Items, &gopher.Item{
+			Type:        item_type,
+			Description: description,
+			Selector:    entry_url,
+		})
+		// The item type shows what the page was, but following the link
+		// jumps back to it, even for searches that would ask for input
+		links = append(links, &core.Link{Type: core.GopherDirectory, Url: entry_url, Description: description,
+			ItemType: item_type})
+	}
+	content, _ := dir.ToText()
+	return &core.Page{
+		Type:    core.GopherDirectory,
+		Url:     HISTORY_URL,
+		Title:   "History",
+		Content: string(content),
+		Links:   links,
+	}
+}
+
+// Jump to the page of a link on the history page, a url like
+// "about:history?index=3". Returns false for any other url.
+func (c *Client) gotoHistoryEntry(url string) bool {
+	if url == HISTORY_URL {
+		c.CommandHistory()
+		return true
+	}
+	if !strings.HasPrefix(url, HISTORY_URL+HISTORY_INDEX_QUERY) {
+		return false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(url, HISTORY_URL+HISTORY_INDEX_QUERY))
+	if err != nil {
+		return false
+	}
+	c.SaveScroll()
+	if page := c.HistoryManager.GoTo(index); page != nil {
+		c.stopAutoreload()
+		c.PageView.RenderPage(page)
+		c.UpdateTabBar()
+	} else {
+		AppLog.Errorf("No page #%d in the history", index+1)
+	}
+	return true
+}
+
+// Follow the link whose description best matches the text in args, or
+// ask for the text if there is none. When several links match equally
+// well, they are listed to pick from.
+func (c *Client) CommandLinkFind(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil || len(page.Links) == 0 {
+		AppLog.Info("No links on this page")
+		return
+	}
+	if len(args) == 0 {
+		c.BuildCommandLine("Find link: ", func(commandLine *tview.InputField, key tcell.Key) {
+			if key == tcell.KeyEnter && strings.TrimSpace(commandLine.GetText()) != "" {
+				c.CommandLinkFind(strings.Fields(commandLine.GetText()))
+			}
+		})
+		return
+	}
+	pattern := strings.Join(args, " ")
+	best_score := 0
+	var best_links []int
+	for i, link := range page.Links {
+		text := link.Description
+		if text == "" {
+			text = link.Url
+		}
+		score, ok := fuzzyScore(pattern, text)
+		if !ok || score < best_score {
+			continue
+		}
+		if score > best_score {
+			best_score = score
+			best_links = nil
+		}
+		best_links = append(best_links, i+1)
+	}
+	if len(best_links) == 0 {
+		AppLog.Errorf("No link matches \"%s\"", pattern)
+		return
+	}
+	if len(best_links) == 1 {
+		c.FollowLink(page, best_links[0])
+		return
+	}
+	linkList := tview.NewList()
+	linkList.SetBorder(true)
+	linkList.SetTitle(fmt.Sprintf("Links matching \"%s\"", tview.Escape(pattern)))
+	linkList.SetBackgroundColor(tcell.ColorDefault)
+	closeList := func() {
+		c.App.SetRoot(c.GridLayout, true).SetFocus(c.PageView.PageText)
+		c.active_view = c.PageView.PageText
+	}
+	for i, link_num := range best_links {
+		link_num := link_num
+		link := page.Links[link_num-1]
+		var shortcut rune
+		if i < 9 {
+			shortcut = rune('1' + i)
+		}
+		linkList.AddItem(fmt.Sprintf("[%d] %s", link_num, tview.Escape(link.Description)),
+			tview.Escape(link.Url), shortcut, func() {
+				closeList()
+				c.FollowLink(page, link_num)
+			})
+	}
+	linkList.SetDoneFunc(closeList)
+	c.App.SetRoot(linkList, true).SetFocus(linkList)
+	c.active_view = linkList
+}
+
+// Score how well pattern matches text, higher is better. The characters of
+// pattern must all appear in text in order, ignoring case. Runs of
+// consecutive characters and matches at the start of words score more.
+func fuzzyScore(pattern string, text string) (int, bool) {
+	pattern_runes := []rune(strings.ToLower(pattern))
+	text_runes := []rune(strings.ToLower(text))
+	score := 0
+	matched := 0
+	prev_match := -2
+	for i, r := range text_runes {
+		if matched == len(pattern_runes) {
+			break
+		}
+		if r != pattern_runes[matched] {
+			continue
+		}
+		score += 1
+		if i == prev_match+1 {
+			score += 5
+		}
+		if i == 0 || !unicode.IsLetter(text_runes[i-1]) && !unicode.IsDigit(text_runes[i-1]) {
+			score += 3
+		}
+		prev_match = i
+		matched++
+	}
+	if matched < len(pattern_runes) {
+		return 0, false
+	}
+	if strings.Contains(string(text_runes), string(pattern_runes)) {
+		score += 10
+	}
+	return score, true
+}
+
+// Save the source of the current page to the download directory. The file
+// is named after the first argument, or the url if none is given. If the url
+// doesn't have a file name either, ask for one.
+func (c *Client) CommandSave(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to save")
+		return
+	}
+	content := page.Content
+	name := strings.Join(args, " ")
+	if name == "" {
+		name = core.UrlFileName(page.Url)
+	}
+	if name != "" {
+		core.SaveDownload(c.config.coreSettings(), name, strings.NewReader(content))
+		return
+	}
+	c.BuildCommandLine("Save as: ", func(commandLine *tview.InputField, key tcell.Key) {
+		if key == tcell.KeyEnter && commandLine.GetText() != "" {
+			core.SaveDownload(c.config.coreSettings(), commandLine.GetText(), strings.NewReader(content))
+		}
+	})
+}
+
+// Exit the program, asking first if confirm_quit is set or downloads are
+// still running
+func (c *Client) CommandQuit() {
+	prompt := "Quit? (y/n) "
+	if running := runningDownloads(c.downloads); running > 0 {
+		prompt = fmt.Sprintf("%d downloads not finished, quit anyway? (y/n) ", running)
+	} else if !c.config.ConfirmQuit {
+		c.App.Stop()
+		return
+	}
+	c.BuildCommandLine(prompt, func(commandLine *tview.InputField, key tcell.Key) {
+		answer := strings.ToLower(strings.TrimSpace(commandLine.GetText()))
+		if key == tcell.KeyEnter && (answer == "y" || answer == "yes") {
+			c.App.Stop()
+		}
+	})
+}
+
+// Hide the status line and message line to give the page more room, or
+// show them again
+func (c *Client) CommandZen() {
+	c.setZen(!c.zen)
+}
+
+func (c *Client) setZen(zen bool) {
+	c.zen = zen
+	c.GridLayout.RemoveItem(c.PageView.StatusLine)
+	c.GridLayout.RemoveItem(c.MessageLine)
+	if zen {
+		c.GridLayout.SetRows(0, 1)
+	} else {
+		c.GridLayout.SetRows(0, 1, 1, 1)
+		c.GridLayout.AddItem(c.PageView.StatusLine, 2, 0, 1, GRID_COLUMNS, 0, 0, false)
+		c.GridLayout.AddItem(c.MessageLine, MESSAGE_LINE_ROW, 0, 1, GRID_COLUMNS, 0, 0, false)
+	}
+}
+
+func (c *Client) CommandHome() {
+	c.GotoUrl(c.config.HomePage)
 }
 
 func (c *Client) CommandGoToRoot() {
@@ -455,10 +2528,34 @@ func (c *Client) CommandGoToRoot() {
 	c.GotoUrl(root_url)
 }
 
+// Find the page that links to page, and the number of that link.
+// The recorded Parent is used if it still links to page, otherwise the
+// previous page in the history is checked so next/prev keep working after
+// moving through the history. Returns nil if no parent is found.
+func (c *Client) linkParent(page *core.Page) (*core.Page, int) {
+	parent := page.Parent
+	if parent != nil && page.LinkIndex >= 1 && page.LinkIndex <= len(parent.Links) &&
+		parent.Links[page.LinkIndex-1].Url == page.Url {
+		return parent, page.LinkIndex
+	}
+	prev_page := c.HistoryManager.PreviousPage()
+	if prev_page == nil || prev_page == page {
+		return nil, 0
+	}
+	for i, link := range prev_page.Links {
+		if link.Url == page.Url {
+			page.Parent = prev_page
+			page.LinkIndex = i + 1
+			return prev_page, i + 1
+		}
+	}
+	return nil, 0
+}
+
 func (c *Client) CommandGoNext() {
 	cur_page := c.HistoryManager.CurrentPage()
-	parent_page := cur_page.Parent
-	next_index := cur_page.LinkIndex + 1
+	parent_page, link_index := c.linkParent(cur_page)
+	next_index := link_index + 1
 	if parent_page != nil && next_index <= len(parent_page.Links) {
 		c.FollowLink(parent_page, next_index)
 	} else {
@@ -469,67 +2566,720 @@ func (c *Client) CommandGoNext() {
 
 func (c *Client) CommandGoPrev() {
 	cur_page := c.HistoryManager.CurrentPage()
-	parent_page := cur_page.Parent
-	prev_index := cur_page.LinkIndex - 1
-	if parent_page != nil && prev_index < 0 {
+	parent_page, link_index := c.linkParent(cur_page)
+	prev_index := link_index - 1
+	if parent_page != nil && prev_index >= 1 {
 		c.FollowLink(parent_page, prev_index)
 	} else {
 		AppLog.Error("No previous link in parent page to navigate to")
 	}
 }
 
+// Bookmark the current page. Arguments starting with + are tags, like
+// "+news", the others are used as the bookmark title.
+func (c *Client) CommandBookmarkAdd(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to bookmark")
+		return
+	}
+	var title_words []string
+	var tags []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "+") && len(arg) > 1 {
+			tags = append(tags, arg[1:])
+		} else {
+			title_words = append(title_words, arg)
+		}
+	}
+	title := strings.Join(title_words, " ")
+	if title == "" {
+		title = page.Url
+	}
+	c.Bookmarks.Add(title, page.Url, tags)
+	if err := c.Bookmarks.Save(); err != nil {
+		AppLog.Errorf("Failed to save bookmarks: %v", err)
+		return
+	}
+	AppLog.Infof("Bookmarked %s", page.Url)
+}
+
+// Delete the bookmark with the number given as an argument, or the
+// bookmark for the current page. Numbers are those shown on the bookmark
+// page being viewed, like a tag page, or in the full list otherwise.
+func (c *Client) CommandBookmarkDel(args []string) {
+	var index int
+	if len(args) > 0 {
+		bookmark_num, err := strconv.Atoi(args[0])
+		if err != nil {
+			AppLog.Errorf("Not a bookmark number: \"%s\"", args[0])
+			return
+		}
+		index = bookmark_num - 1
+		page := c.HistoryManager.CurrentPage()
+		if page != nil && page.Url != BOOKMARKS_URL && c.Bookmarks.Page(page.Url) != nil {
+			index = -1
+			if bookmark_num > 0 && bookmark_num <= len(page.Links) {
+				index = c.Bookmarks.Find(page.Links[bookmark_num-1].Url)
+			}
+		}
+	} else if page := c.HistoryManager.CurrentPage(); page != nil {
+		index = c.Bookmarks.Find(page.Url)
+	} else {
+		index = -1
+	}
+	if !c.Bookmarks.Remove(index) {
+		AppLog.Error("No such bookmark")
+		return
+	}
+	if err := c.Bookmarks.Save(); err != nil {
+		AppLog.Errorf("Failed to save bookmarks: %v", err)
+		return
+	}
+	AppLog.Info("Bookmark deleted")
+	// Refresh the bookmark list in place if it's being viewed
+	if page := c.HistoryManager.CurrentPage(); page != nil {
+		if bookmarks_page := c.Bookmarks.Page(page.Url); bookmarks_page != nil {
+			*page = *bookmarks_page
+			c.PageView.RenderPage(page)
+		}
+	}
+}
+
+func (c *Client) CommandBookmarkList() {
+	c.ShowPage(c.Bookmarks.ToPage())
+}
+
+// Show the bookmarks tagged with the tag given as an argument, or the list
+// of tags without one
+func (c *Client) CommandBookmarkTag(args []string) {
+	if len(args) == 0 {
+		c.ShowPage(c.Bookmarks.TagsPage())
+		return
+	}
+	c.ShowPage(c.Bookmarks.TagPage(strings.Join(args, " ")))
+}
+
+// Ask for a search query. Matches are highlighted while it is typed, and
+// Escape goes back to where the page was scrolled before.
+func (c *Client) CommandSearch() {
+	last_query := c.searchQuery
+	row, col := c.PageView.PageText.GetScrollOffset()
+	c.buildCommandLine("/", "", false, func(text string) {
+		c.previewSearch(text, row, col)
+	}, func(commandLine *tview.InputField, key tcell.Key) {
+		if key != tcell.KeyEnter {
+			c.searchQuery = last_query
+			c.searchPage = nil
+			c.PageView.PageText.Highlight()
+			c.PageView.PageText.ScrollTo(row, col)
+			c.PageView.UpdateStatus()
+			return
+		}
+		// An empty query repeats the last search
+		if commandLine.GetText() == "" {
+			c.searchQuery = last_query
+			c.searchPage = nil
+		} else if c.searchPage != c.HistoryManager.CurrentPage() {
+			c.searchPage = nil
+		}
+		// Start over from the first match the preview went to
+		c.searchIndex = -1
+		c.CommandSearchNext()
+	})
+}
+
+// Highlight the matches of query while it is being typed and scroll to the
+// first one, or back to row and col if there are none
+func (c *Client) previewSearch(query string, row int, col int) {
+	c.searchQuery = query
+	c.searchPage = nil
+	c.searchMatches = nil
+	if query != "" {
+		c.updateSearchMatches()
+	}
+	if len(c.searchMatches) == 0 {
+		c.PageView.PageText.Highlight()
+		c.PageView.PageText.ScrollTo(row, col)
+	} else {
+		c.PageView.PageText.Highlight("search-0").ScrollToHighlight()
+	}
+	c.PageView.UpdateStatus()
+}
+
+func (c *Client) CommandSearchNext() {
+	c.jumpToSearchMatch(1)
+}
+
+func (c *Client) CommandSearchPrev() {
+	c.jumpToSearchMatch(-1)
+}
+
+// Find the lines of the current page matching the search query, unless they
+// are already known. Matches are rescanned if the page was re-rendered since,
+// as that drops the highlight regions.
+func (c *Client) updateSearchMatches() {
+	page := c.HistoryManager.CurrentPage()
+	if page == c.searchPage && (len(c.searchMatches) == 0 ||
+		c.PageView.PageText.GetRegionText("search-0") != "") {
+		return
+	}
+	c.searchPage = page
+	c.searchMatches = nil
+	c.searchIndex = -1
+	query := strings.ToLower(c.searchQuery)
+	for i, line := range strings.Split(c.PageView.PageText.GetText(true), "\n") {
+		if strings.Contains(strings.ToLower(line), query) {
+			c.searchMatches = append(c.searchMatches, i)
+		}
+	}
+	c.PageView.MarkSearchMatches(c.searchMatches)
+}
+
+// Highlight and scroll to the match step matches away from the current one
+func (c *Client) jumpToSearchMatch(step int) {
+	if c.searchQuery == "" {
+		AppLog.Error("No previous search")
+		return
+	}
+	c.updateSearchMatches()
+	n_matches := len(c.searchMatches)
+	if n_matches == 0 {
+		AppLog.Errorf("Pattern not found: %s", c.searchQuery)
+		return
+	}
+	if c.searchIndex < 0 {
+		if step > 0 {
+			c.searchIndex = 0
+		} else {
+			c.searchIndex = n_matches - 1
+		}
+	} else {
+		c.searchIndex = (c.searchIndex + step + n_matches) % n_matches
+	}
+	c.PageView.PageText.Highlight(fmt.Sprintf("search-%d", c.searchIndex)).ScrollToHighlight()
+	fmt.Fprintf(c.MessageLine, "/%s [%d/%d]", tview.Escape(c.searchQuery), c.searchIndex+1, n_matches)
+}
+
+// Copy text to the system clipboard, reporting what was copied
+func copyToClipboard(text string) {
+	if err := clipboard.WriteAll(text); err != nil {
+		AppLog.Errorf("Failed to copy to clipboard: %v", err)
+		return
+	}
+	AppLog.Infof("Copied %s to clipboard", text)
+}
+
+// Select lines to copy, starting from the top of the view. j and k extend
+// the selection, y copies it and Escape leaves without copying.
+func (c *Client) CommandVisual() {
+	if c.HistoryManager.CurrentPage() == nil {
+		AppLog.Error("No page to select from")
+		return
+	}
+	c.PageView.StartSelection()
+	fmt.Fprint(c.MessageLine, "-- VISUAL --")
+}
+
+func (c *Client) visualInputHandler(event *tcell.EventKey) *tcell.EventKey {
+	switch {
+	case event.Key() == tcell.KeyEscape || event.Rune() == 'v':
+		c.PageView.EndSelection()
+		return nil
+	case event.Key() == tcell.KeyDown || event.Rune() == 'j':
+		c.PageView.MoveSelection(1)
+	case event.Key() == tcell.KeyUp || event.Rune() == 'k':
+		c.PageView.MoveSelection(-1)
+	case event.Rune() == 'y':
+		text := c.PageView.SelectedText()
+		c.PageView.EndSelection()
+		if err := clipboard.WriteAll(text); err != nil {
+			AppLog.Errorf("Failed to copy to clipboard: %v", err)
+			return nil
+		}
+		n_lines := strings.Count(text, "\n") + 1
+		AppLog.Infof("Copied %d line(s) to clipboard", n_lines)
+		return nil
+	}
+	fmt.Fprint(c.MessageLine, "-- VISUAL --")
+	return nil
+}
+
+// Copy the content of the current page, as it was received
+func (c *Client) CommandCopyPage() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to copy")
+		return
+	}
+	if err := clipboard.WriteAll(page.Content); err != nil {
+		AppLog.Errorf("Failed to copy to clipboard: %v", err)
+		return
+	}
+	AppLog.Infof("Copied %s of page content to clipboard", core.FormatByteCount(int64(len(page.Content))))
+}
+
+// The current page if it is a gopher directory
+func (c *Client) currentDirectory() *core.Page {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil || (page.Type != core.GopherDirectory && page.Type != core.GopherQuery) {
+		AppLog.Error("Not a gopher directory")
+		return nil
+	}
+	return page
+}
+
+// Show only the items of the current directory whose description contains
+// the words in args, asking for them if args is empty. Going back shows the
+// whole directory again.
+func (c *Client) CommandFilter(args []string) {
+	page := c.currentDirectory()
+	if page == nil {
+		return
+	}
+	if len(args) == 0 {
+		c.BuildCommandLine("Filter: ", func(commandLine *tview.InputField, key tcell.Key) {
+			if key == tcell.KeyEnter && strings.TrimSpace(commandLine.GetText()) != "" {
+				c.CommandFilter([]string{commandLine.GetText()})
+			}
+		})
+		return
+	}
+	pattern := strings.Join(args, " ")
+	lower_pattern := strings.ToLower(pattern)
+	var matches []core.GopherDirectoryItem
+	for _, item := range core.GopherDirectoryItems(page) {
+		if strings.Contains(strings.ToLower(item.Item.Description), lower_pattern) {
+			matches = append(matches, item)
+		}
+	}
+	if len(matches) == 0 {
+		AppLog.Errorf("No items match \"%s\"", pattern)
+		return
+	}
+	title := strings.TrimSpace(fmt.Sprintf("%s (filter: %s)", page.Title, pattern))
+	c.ShowPage(core.GopherDirectoryPage(page, title, matches))
+}
+
+// List the items of the current directory ordered by their description.
+// Going back shows the directory as the server ordered it.
+func (c *Client) CommandSort() {
+	page := c.currentDirectory()
+	if page == nil {
+		return
+	}
+	items := core.GopherDirectoryItems(page)
+	sort.SliceStable(items, func(i, j int) bool {
+		return strings.ToLower(items[i].Item.Description) < strings.ToLower(items[j].Item.Description)
+	})
+	title := strings.TrimSpace(fmt.Sprintf("%s (sorted)", page.Title))
+	c.ShowPage(core.GopherDirectoryPage(page, title, items))
+}
+
+// Run a shell command with the content of the current page as its input.
+// Asks for the command if args is empty. Output of one line is shown in the
+// message line, longer output in a view of its own.
+func (c *Client) CommandPipe(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to pipe")
+		return
+	}
+	if len(args) == 0 {
+		c.BuildCommandLine("Pipe to: ", func(commandLine *tview.InputField, key tcell.Key) {
+			if key == tcell.KeyEnter && strings.TrimSpace(commandLine.GetText()) != "" {
+				c.CommandPipe([]string{commandLine.GetText()})
+			}
+		})
+		return
+	}
+	command := strings.Join(args, " ")
+	go func() {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = strings.NewReader(page.Content)
+		output, err := cmd.CombinedOutput()
+		c.App.QueueUpdateDraw(func() {
+			if err != nil {
+				AppLog.Errorf("\"%s\" failed: %v", command, err)
+			}
+			text := strings.TrimRight(string(output), "\n")
+			if text == "" {
+				return
+			}
+			if !strings.Contains(text, "\n") {
+				AppLog.Info(tview.Escape(text))
+				return
+			}
+			c.showOutput(command, text)
+		})
+	}()
+}
+
+// Show the output of a command in a view that closes with escape or q
+func (c *Client) showOutput(title string, output string) *tview.TextView {
+	outputView := tview.NewTextView()
+	outputView.SetBorder(true)
+	outputView.SetTitle(tview.Escape(title))
+	outputView.SetDynamicColors(true)
+	outputView.SetBackgroundColor(tcell.ColorDefault)
+	outputView.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Rune() == 'q' || event.Key() == tcell.KeyEscape {
+			c.App.SetRoot(c.GridLayout, true).SetFocus(c.PageView.PageText)
+			c.active_view = c.PageView.PageText
+			return nil
+		}
+		return event
+	})
+	fmt.Fprint(tview.ANSIWriter(outputView), tview.Escape(output))
+	c.App.SetRoot(outputView, true).SetFocus(outputView)
+	c.active_view = outputView
+	return outputView
+}
+
+// Show the files downloaded this session, and the progress of those still
+// downloading
+func (c *Client) CommandDownloads() {
+	c.downloadsView = c.showOutput("Downloads", downloadsText(c.downloads))
+}
+
+// Show the latest progress in the downloads view, if it is open
+func (c *Client) refreshDownloads() {
+	if c.downloadsView == nil || c.active_view != c.downloadsView {
+		c.downloadsView = nil
+		return
+	}
+	c.downloadsView.Clear()
+	fmt.Fprint(c.downloadsView, tview.Escape(downloadsText(c.downloads)))
+}
+
+func downloadsText(downloads *core.Downloads) string {
+	started := downloads.Downloads()
+	if len(started) == 0 {
+		return "No downloads yet"
+	}
+	var text strings.Builder
+	for _, download := range started {
+		status := "Downloading"
+		if done, err := download.Done(); err != nil {
+			status = fmt.Sprintf("Failed: %v", err)
+		} else if done {
+			status = "Done"
+		}
+		fmt.Fprintf(&text, "%s\n  %s\n  %s, %s\n\n", download.Path, download.Url,
+			core.FormatByteCount(download.Received()), status)
+	}
+	return text.String()
+}
+
+// Number of downloads that haven't finished yet
+func runningDownloads(downloads *core.Downloads) int {
+	running := 0
+	for _, download := range downloads.Downloads() {
+		if done, _ := download.Done(); !done {
+			running += 1
+		}
+	}
+	return running
+}
+
+// Show the details of the current page, and the pages followed to get to it
+func (c *Client) CommandInfo() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to show info about")
+		return
+	}
+	var info strings.Builder
+	fmt.Fprintf(&info, "Title: %s\n", page.Title)
+	fmt.Fprintf(&info, "Url:   %s\n", page.Url)
+	if parsed_url, err := url.Parse(page.Url); err == nil && parsed_url.Host != "" {
+		port := parsed_url.Port()
+		if port == "" {
+			port = defaultPorts[parsed_url.Scheme]
+		}
+		fmt.Fprintf(&info, "Host:  %s\n", parsed_url.Hostname())
+		fmt.Fprintf(&info, "Port:  %s\n", port)
+	}
+	fmt.Fprintf(&info, "Type:  %s\n", page.Type)
+	fmt.Fprintf(&info, "Size:  %s\n", core.FormatByteCount(int64(len(page.Content))))
+	fmt.Fprintf(&info, "Links: %d\n", len(page.Links))
+	// Parents are only recorded for pages reached by following a link
+	seen := map[*core.Page]bool{page: true}
+	parent, link_index := page.Parent, page.LinkIndex
+	for parent != nil && !seen[parent] {
+		if len(seen) == 1 {
+			info.WriteString("\nReached from:\n")
+		}
+		seen[parent] = true
+		title := parent.Title
+		if title == "" {
+			title = parent.Url
+		}
+		fmt.Fprintf(&info, "  link %d of %s (%s)\n", link_index, title, parent.Url)
+		parent, link_index = parent.Parent, parent.LinkIndex
+	}
+	c.showOutput("Page info", info.String())
+}
+
+func (c *Client) CommandYankUrl() {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to copy the url of")
+		return
+	}
+	copyToClipboard(page.Url)
+}
+
+// Default ports of the schemes a url's port can be left out for
+var defaultPorts = map[string]string{
+	"gopher":  core.GOPHER_DEFAULT_PORT,
+	"gophers": core.GOPHERS_DEFAULT_PORT,
+	"gemini":  core.GEMINI_DEFAULT_PORT,
+	"spartan": core.SPARTAN_DEFAULT_PORT,
+	"finger":  core.FINGER_DEFAULT_PORT,
+	"http":    "80",
+	"https":   "443",
+}
+
+// Fill in a share_format template for page. %t is replaced by the title, or
+// the url if there is none, %u by the url, %h by the host, %p by the port,
+// %s by the selector and %% by a single %. The selector of gopher urls is
+// given without the item type.
+func formatShare(format string, page *core.Page) string {
+	title := page.Title
+	if title == "" {
+		title = page.Url
+	}
+	var host, port, selector string
+	if parsed_url, err := url.Parse(page.Url); err == nil {
+		host = parsed_url.Hostname()
+		port = parsed_url.Port()
+		if port == "" {
+			port = defaultPorts[parsed_url.Scheme]
+		}
+		selector = parsed_url.Path
+		if parsed_url.Scheme == "gopher" || parsed_url.Scheme == "gophers" {
+			var search_term string
+			_, selector, search_term = core.SplitGopherUrl(parsed_url)
+			if search_term != "" {
+				selector += "\t" + search_term
+			}
+		}
+	}
+	replacer := strings.NewReplacer("%t", title, "%u", page.Url, "%h", host, "%p", port,
+		"%s", selector, "%%", "%")
+	return replacer.Replace(format)
+}
+
+// Copy a reference to the current page, formatted with the share_format
+// config setting, or with the template given as arguments
+func (c *Client) CommandYankShare(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if page == nil {
+		AppLog.Error("No page to share")
+		return
+	}
+	format := c.config.ShareFormat
+	if len(args) > 0 {
+		format = strings.Join(args, " ")
+	}
+	copyToClipboard(formatShare(format, page))
+}
+
+// Copy the url of the link with the number given as an argument
+func (c *Client) CommandYankLink(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if len(args) == 0 || page == nil {
+		AppLog.Error("Usage: yank-link <link number>")
+		return
+	}
+	link_num, err := strconv.Atoi(args[0])
+	if err != nil || link_num < 1 || link_num > len(page.Links) {
+		AppLog.Errorf("No link #%s on the current page", args[0])
+		return
+	}
+	copyToClipboard(page.Links[link_num-1].Url)
+}
+
+// Scroll so line args[0] is at the top, asking for it if args is empty
+func (c *Client) CommandGotoLine(args []string) {
+	if c.HistoryManager.CurrentPage() == nil {
+		AppLog.Error("No page to scroll")
+		return
+	}
+	if len(args) == 0 {
+		c.BuildCommandLine("Line: ", func(commandLine *tview.InputField, key tcell.Key) {
+			if key == tcell.KeyEnter && strings.TrimSpace(commandLine.GetText()) != "" {
+				c.CommandGotoLine(strings.Fields(commandLine.GetText()))
+			}
+		})
+		return
+	}
+	line, err := strconv.Atoi(args[0])
+	if err != nil {
+		AppLog.Errorf("No line %s on the current page", args[0])
+		return
+	}
+	c.gotoLine(line)
+}
+
+func (c *Client) gotoLine(line int) {
+	if !c.PageView.ScrollToLine(line) {
+		AppLog.Errorf("No line %d on the current page", line)
+		return
+	}
+	c.PageView.UpdateStatus()
+}
+
+// Show where a link goes without following it
+func (c *Client) CommandPeek(args []string) {
+	page := c.HistoryManager.CurrentPage()
+	if len(args) == 0 || page == nil {
+		AppLog.Error("Usage: peek <link number>")
+		return
+	}
+	link_num, err := strconv.Atoi(args[0])
+	if err != nil || link_num < 1 || link_num > len(page.Links) {
+		AppLog.Errorf("No link #%s on the current page", args[0])
+		return
+	}
+	link := page.Links[link_num-1]
+	if link.Description != "" && link.Description != link.Url {
+		AppLog.Infof("[%d] %s: %s -> %s", link_num, link.Type, tview.Escape(link.Description), link.Url)
+	} else {
+		AppLog.Infof("[%d] %s: %s", link_num, link.Type, link.Url)
+	}
+}
+
+// The url one level up from url_str. Query strings, gopher search terms and
+// trailing slashes are dropped first. The parent of a gopher selector is
+// assumed to be a directory, so its item type becomes 1. The root url is
+// returned for urls already at the root.
 func GetUpUrl(url_str string) string {
 	parsed_url, err := url.Parse(url_str)
 	if err != nil {
 		AppLog.Error(err)
 		return ""
 	}
-	path := strings.Split(parsed_url.Path, "/")
-	if len(path) <= 2 { // 2 because "/1" -> ["", "1"]
-		return fmt.Sprintf("%s://%s", parsed_url.Scheme, parsed_url.Host)
+	is_gopher := parsed_url.Scheme == "gopher" || parsed_url.Scheme == "gophers"
+	selector := parsed_url.Path
+	if is_gopher {
+		_, selector, _ = core.SplitGopherUrl(parsed_url)
+	}
+	selector = strings.TrimRight(selector, "/")
+	parent := ""
+	if slash := strings.LastIndex(selector, "/"); slash >= 0 {
+		parent = selector[:slash]
 	}
-	up_path := path[1 : len(path)-1]
-	up_path[0] = "1" // Assumes the parent page is a directory. Probably safe?
-	up_url := fmt.Sprintf("%s://%s/%s", parsed_url.Scheme, parsed_url.Host, strings.Join(up_path, "/"))
-	return up_url
+
+	up_url := url.URL{Scheme: parsed_url.Scheme, Host: parsed_url.Host}
+	switch {
+	case parent == "" && is_gopher:
+		up_url.Path = ""
+	case parent == "":
+		up_url.Path = "/"
+	case is_gopher:
+		up_url.Path = "/1" + parent
+	default:
+		up_url.Path = parent + "/"
+	}
+	return up_url.String()
 }
 
 func (c *Client) CommandGoUp() {
 	cur_url := c.HistoryManager.CurrentPage().Url
 	up_url := GetUpUrl(cur_url)
+	if up_url == "" {
+		return
+	}
+	if strings.TrimSuffix(up_url, "/") == strings.TrimSuffix(cur_url, "/") {
+		AppLog.Info("Already at the top")
+		return
+	}
 	c.GotoUrl(up_url)
 }
 
+// Fetch _url and print it to stdout without starting the UI. Text files are
+// printed as received, directories and gemtext as they are rendered, with
+// link numbers. Returns false if the url could not be fetched.
+func DumpUrl(config UserConfig, _url string) bool {
+	settings := config.coreSettings()
+	settings.Downloads = core.NewDownloads()
+	page, err := core.Fetch(settings, _url)
+	if err != nil {
+		AppLog.Errorf("Failed to load %s: %v", _url, err)
+		return false
+	}
+	// Downloaded rather than shown
+	if page == nil {
+		settings.Downloads.WaitDownloads()
+		return true
+	}
+	pageView := NewPageView()
+	pageView.DetectInfoLinks = config.DetectInfoLinks
+	switch page.Type {
+	case core.GopherDirectory, core.GopherQuery:
+		pageView.RenderGopherDirectory(page)
+	case core.GemtextType:
+		pageView.RenderGemtext(page)
+	default:
+		fmt.Print(page.Content)
+		return true
+	}
+	fmt.Print(pageView.PageText.GetText(true))
+	return true
+}
+
 func main() {
 	// Parse cli arguments:
 	var log_path string
 	var user_config_file string
+	var dump_url string
 	var err error
 	flag.StringVar(&log_path, "l", "", "File path to write logging information to.")
+	flag.StringVar(&log_path, "log", "", "Same as -l")
 	flag.StringVar(&user_config_file, "c", "", "Specify user configuration file")
+	flag.StringVar(&user_config_file, "config", "", "Same as -c")
+	flag.StringVar(&dump_url, "dump", "", "Print the content of a url to stdout and exit")
 	flag.Parse()
 	var init_url = flag.Arg(0)
 
 	// Parse user config file
 
 	if user_config_file == "" {
-		user_config_file, err = xdg.ConfigFile("viscacha.json")
-		if err != nil {
-			AppLog.Error(err)
-		}
+		home, _ := os.UserHomeDir()
+		user_config_file = findConfigFile(home, xdg.ConfigHome, xdg.ConfigDirs)
 	}
 	userConfig := ReadConfig(user_config_file)
 
-	if init_url == "" {
-		init_url = userConfig.HomePage
+	if dump_url != "" {
+		if !DumpUrl(userConfig, dump_url) {
+			os.Exit(1)
+		}
+		return
 	}
 
 	// Build tview Application UI
 	client := NewClient(userConfig)
+	client.configPath = user_config_file
+
+	bookmarks_path, err := xdg.DataFile("viscacha/bookmarks.json")
+	if err != nil {
+		AppLog.Error(err)
+	}
+	client.Bookmarks = LoadBookmarks(bookmarks_path)
+
+	if userConfig.SaveCommandHistory {
+		client.commandHistoryPath, err = xdg.DataFile("viscacha/command_history")
+		if err != nil {
+			AppLog.Error(err)
+		}
+		client.commandHistory = LoadCommandHistory(client.commandHistoryPath)
+	}
 
 	// Setup log file handling
 	if log_path == "" {
-		log_path, err = xdg.DataFile("viscacha/viscacha.log")
+		log_path, err = xdg.DataFile(DEFAULT_LOG_PATH)
 		if err != nil {
 			AppLog.Error(err)
 		}
@@ -539,6 +3289,7 @@ func main() {
 		AppLog.Error(err)
 	} else {
 		defer logFile.Close()
+		client.logPath = log_path
 	}
 	buffer_log_backend := logging.NewLogBackend(&client.LogBuffer, "", 0)
 	msg_line_log_backend := logging.NewLogBackend(tview.ANSIWriter(client.MessageLine), "", 0)
@@ -552,21 +3303,41 @@ func main() {
 	msg_line_log_format := logging.MustStringFormatter(
 		`%{color}%{message}%{color:reset}`,
 	)
-	fmt_msg_line_log_backend := logging.NewBackendFormatter(msg_line_log_backend, msg_line_log_format)
+	fmt_msg_line_log_backend := logging.AddModuleLevel(
+		logging.NewBackendFormatter(msg_line_log_backend, msg_line_log_format))
+	// Request timings are only for the log file and log view
+	fmt_msg_line_log_backend.SetLevel(logging.WARNING, "handler")
 	fmt_file_log_backend := logging.NewBackendFormatter(file_log_backend, verbose_log_format)
 	fmt_old_log_backend := logging.NewBackendFormatter(buffer_log_backend, log_format)
 	logging.SetBackend(fmt_msg_line_log_backend, fmt_file_log_backend, fmt_old_log_backend)
 
-	// Go to a URL
-	client.GotoUrl(init_url)
-	time.AfterFunc(50*time.Millisecond, func() {
-		// Hacks to get UpdateStatus to detect the correct terminal width on startup
-		client.App.QueueUpdateDraw(func() {
-			client.PageView.UpdateStatus()
-		})
-	})
+	var session_path string
+	if userConfig.RestoreSession {
+		session_path, err = xdg.DataFile(DEFAULT_SESSION_PATH)
+		if err != nil {
+			AppLog.Error(err)
+		}
+	}
 
+	// Go to a URL, the status line is filled in once the screen size is known
+	var session *Session
+	if session_path != "" && init_url == "" {
+		session = LoadSession(session_path)
+	}
+	if session != nil {
+		client.RestoreSession(session)
+	} else {
+		if init_url == "" {
+			init_url = userConfig.HomePage
+		}
+		client.GotoUrl(init_url)
+	}
 	if err := client.App.Run(); err != nil {
 		panic(err)
 	}
+	if session_path != "" {
+		if err := client.CurrentSession().Save(session_path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save session: %v\n", err)
+		}
+	}
 }
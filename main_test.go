@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/ottopasuuna/viscacha/core"
+	"github.com/rivo/tview"
+)
+
+// A client with the widgets commands update, not run by an application, and
+// a tab for each url with that page in it. Pages put in its cache are loaded
+// without being fetched.
+func newTestClient(tab_urls ...string) *Client {
+	client := &Client{
+		PageView:    NewPageView(),
+		TabBar:      tview.NewTextView(),
+		MessageLine: tview.NewTextView(),
+		Cache:       NewPageCache(10, time.Minute),
+		visitedUrls: make(map[string]bool),
+		downloads:   core.NewDownloads(),
+	}
+	for _, tab_url := range tab_urls {
+		tab := &HistoryManager{}
+		tab.Navigate(&core.Page{Type: core.TextType, Url: tab_url})
+		client.Tabs = append(client.Tabs, tab)
+	}
+	client.HistoryManager = client.Tabs[0]
+	return client
+}
+
+// Reloading an image page shows the image the server sends now
+func TestReloadImage(t *testing.T) {
+	var served bytes.Buffer
+	png.Encode(&served, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write(served.Bytes())
+			conn.Close()
+		}
+	}()
+
+	image_url := "gopher://" + listener.Addr().String() + "/I/picture.png"
+	client := newTestClient(image_url)
+	page := &core.Page{Type: core.ImageType, Url: image_url, Image: image.NewRGBA(image.Rect(0, 0, 1, 1))}
+	client.HistoryManager.Navigate(page)
+	client.config.Timeout = core.DEFAULT_TIMEOUT
+	client.config.MaxContentSize = core.DEFAULT_MAX_CONTENT_SIZE
+	client.config.InlineImages = true
+	screen := tcell.NewSimulationScreen("")
+	client.App = tview.NewApplication().SetScreen(screen).SetRoot(client.PageView.PageText, true)
+	go client.App.Run()
+	defer client.App.Stop()
+
+	client.App.QueueUpdate(client.CommandReload)
+	// QueueUpdate waits for the update to run
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		width := 0
+		client.App.QueueUpdate(func() { width = page.Image.Bounds().Dx() })
+		if width == 2 {
+			return
+		}
+	}
+	t.Error("reloaded image not kept in the page")
+}
+
+// Following a link on the history page moves through the history without
+// dropping the pages after the one jumped to
+func TestHistoryPage(t *testing.T) {
+	history := &HistoryManager{}
+	pages := []*core.Page{
+		{Url: "gopher://host/1/", Title: "Home"},
+		{Url: "gopher://host/0/a.txt"},
+		{Url: "gemini://host/"},
+	}
+	for _, page := range pages {
+		history.Navigate(page)
+	}
+	history.Back()
+
+	page := historyPage(history)
+	history.ShowOverlay(page)
+	if history.CurrentPage() != page {
+		t.Fatal("history page not shown over the current page")
+	}
+	want := []string{"gemini://host/", "* gopher://host/0/a.txt", "Home"}
+	if len(page.Links) != len(want) {
+		t.Fatalf("history page has %d links, want %d", len(page.Links), len(want))
+	}
+	for i, link := range page.Links {
+		if link.Description != want[i] {
+			t.Errorf("link %d is %q, want %q", i+1, link.Description, want[i])
+		}
+	}
+	if got := history.Back(); got != pages[1] {
+		t.Errorf("back from the history page shows %+v, want the page under it", got)
+	}
+
+	history.ShowOverlay(page)
+	if got := history.GoTo(0); got != pages[0] || history.CurrentPage() != pages[0] {
+		t.Errorf("jumped to %+v, want the first page", got)
+	}
+	if got := history.Forward(); got != pages[1] {
+		t.Errorf("forward after the jump shows %+v, want the second page", got)
+	}
+	if got := history.Forward(); got != pages[2] {
+		t.Errorf("forward after the jump shows %+v, want the third page", got)
+	}
+
+	// Search results are gone back to, not searched again
+	client := newTestClient("gopher://host/1/")
+	search := &core.Page{Type: core.GopherQuery, Url: "gopher://host/7/search%09cats"}
+	client.HistoryManager.Navigate(search)
+	client.HistoryManager.Navigate(&core.Page{Type: core.TextType, Url: "gopher://host/0/cats.txt"})
+	client.CommandHistory()
+	page = client.HistoryManager.CurrentPage()
+	link := page.Links[1]
+	if link.ItemType != '7' || link.Type == core.GopherQuery {
+		t.Errorf("search result linked as %+v, want a search item that isn't followed as one", link)
+	}
+	client.FollowLink(page, 2)
+	if got := client.HistoryManager.CurrentPage(); got != search {
+		t.Errorf("following the search result shows %+v, want the results", got)
+	}
+}
+
+func TestIsWebUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://example.com/", true},
+		{"https://example.com/page.html", true},
+		{"gopher://host/h/index.html", false},
+		{"gopher://host/hURL:http://example.com/", false},
+		{"gemini://host/", false},
+		{"mailto:me@host", false},
+	}
+	for _, test := range tests {
+		if got := isWebUrl(test.url); got != test.want {
+			t.Errorf("isWebUrl(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+// A closed tab is reopened where it was, not at the end
+func TestReopenTabAtIndex(t *testing.T) {
+	client := newTestClient("gopher://a/", "gopher://b/", "gopher://c/")
+	closed := client.Tabs[1]
+	client.SwitchTab(1)
+	client.CommandTabClose()
+	if len(client.Tabs) != 2 || client.activeTab != 1 {
+		t.Fatalf("%d tabs with tab %d active after closing", len(client.Tabs), client.activeTab+1)
+	}
+	client.CommandReopen()
+	if len(client.Tabs) != 3 || client.Tabs[1] != closed || client.activeTab != 1 || client.HistoryManager != closed {
+		t.Errorf("closed tab not reopened as the active second tab")
+	}
+
+	// Closing the last tab and the one before it reopens them at the end
+	client.SwitchTab(2)
+	client.CommandTabClose()
+	client.CommandTabClose()
+	client.CommandReopen()
+	client.CommandReopen()
+	for i, want := range []string{"gopher://a/", "gopher://b/", "gopher://c/"} {
+		if got := client.Tabs[i].CurrentPage().Url; got != want {
+			t.Errorf("tab %d is %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"bindings": {"x": "quit"}, "homepage": "gemini://example.org/"}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Bindings["x"] != "quit" || len(config.Bindings) != 1 {
+		t.Errorf("bindings %v, want x bound to quit", config.Bindings)
+	}
+	if config.HomePage != "gemini://example.org/" {
+		t.Errorf("homepage %q, want gemini://example.org/", config.HomePage)
+	}
+	// Left out settings get their defaults
+	if config.CacheSize != DEFAULT_CACHE_SIZE {
+		t.Errorf("cache size %d, want %d", config.CacheSize, DEFAULT_CACHE_SIZE)
+	}
+}
+
+// Changing the margins keeps the other settings in the config file
+func TestSaveMaxWidth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"homepage": "gemini://example.org/", "max_width": 80}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMaxWidth(path, 72); err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxWidth != 72 || config.HomePage != "gemini://example.org/" {
+		t.Errorf("got max_width %d and homepage %q, want 72 and gemini://example.org/",
+			config.MaxWidth, config.HomePage)
+	}
+
+	// A config file is created where there was none
+	path = filepath.Join(t.TempDir(), "viscacha", "config.json")
+	if err := saveMaxWidth(path, 60); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := parseConfig(path); err != nil || config.MaxWidth != 60 {
+		t.Errorf("got max_width %d (%v), want 60", config.MaxWidth, err)
+	}
+
+	// One that can't be parsed isn't overwritten
+	path = filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte("{broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMaxWidth(path, 60); err == nil {
+		t.Error("broken config file overwritten")
+	}
+}
+
+// Without a config file the defaults are used, and the error says why
+func TestParseConfigMissingFile(t *testing.T) {
+	config, err := parseConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v, want one for a missing file", err)
+	}
+	if config.HomePage != DEFAULT_HOME_PAGE || config.Bindings["q"] != "quit" {
+		t.Errorf("got %q and bindings %v, want the defaults", config.HomePage, config.Bindings)
+	}
+}
+
+// Next and prev follow the links around the one the page was opened from
+func TestGoNextPrev(t *testing.T) {
+	client := newTestClient("gopher://host/1/")
+	parent := client.HistoryManager.CurrentPage()
+	parent.Type = core.GopherDirectory
+	for _, link_url := range []string{"gopher://host/0/a", "gopher://host/0/b", "gopher://host/0/c"} {
+		parent.Links = append(parent.Links, &core.Link{Type: core.TextType, Url: link_url})
+		client.Cache.Put(&core.Page{Type: core.TextType, Url: link_url, Content: link_url + "\n"})
+	}
+	client.FollowLink(parent, 2)
+
+	steps := []struct {
+		command func()
+		want    string
+	}{
+		{client.CommandGoNext, "gopher://host/0/c"},
+		{client.CommandGoNext, "gopher://host/0/c"}, // No link after the last one
+		{client.CommandGoPrev, "gopher://host/0/b"},
+		{client.CommandGoPrev, "gopher://host/0/a"},
+		{client.CommandGoPrev, "gopher://host/0/a"}, // No link before the first one
+	}
+	for i, step := range steps {
+		step.command()
+		if got := client.HistoryManager.CurrentPage().Url; got != step.want {
+			t.Errorf("step %d is on %s, want %s", i+1, got, step.want)
+		}
+	}
+
+	// Without a recorded parent the previous page in the history is used
+	client.HistoryManager.Navigate(parent)
+	client.HistoryManager.Navigate(&core.Page{Type: core.TextType, Url: "gopher://host/0/b"})
+	client.CommandGoNext()
+	if got := client.HistoryManager.CurrentPage().Url; got != "gopher://host/0/c" {
+		t.Errorf("next from b with no parent is %s, want gopher://host/0/c", got)
+	}
+}
+
+func TestHistoryManager(t *testing.T) {
+	a, b, c, d := &core.Page{Url: "a"}, &core.Page{Url: "b"}, &core.Page{Url: "c"}, &core.Page{Url: "d"}
+	history := &HistoryManager{}
+	if history.CurrentPage() != nil || history.Back() != nil || history.Forward() != nil || history.PreviousPage() != nil {
+		t.Fatal("empty history has pages")
+	}
+	tests := []struct {
+		name     string
+		step     func() *core.Page
+		returned *core.Page
+		current  *core.Page
+		previous *core.Page
+	}{
+		{"navigate to a", func() *core.Page { history.Navigate(a); return a }, a, a, nil},
+		{"back from the first page", history.Back, nil, a, nil},
+		{"navigate to b", func() *core.Page { history.Navigate(b); return b }, b, b, a},
+		{"navigate to c", func() *core.Page { history.Navigate(c); return c }, c, c, b},
+		{"forward from the last page", history.Forward, nil, c, b},
+		{"back to b", history.Back, b, b, a},
+		{"back to a", history.Back, a, a, nil},
+		{"forward to b", history.Forward, b, b, a},
+		// c is dropped from the forward history
+		{"navigate to d", func() *core.Page { history.Navigate(d); return d }, d, d, b},
+		{"forward from d", history.Forward, nil, d, b},
+		{"back to b again", history.Back, b, b, a},
+		{"forward to d", history.Forward, d, d, b},
+	}
+	for _, test := range tests {
+		if got := test.step(); got != test.returned {
+			t.Errorf("%s: returned %v, want %v", test.name, got, test.returned)
+		}
+		if got := history.CurrentPage(); got != test.current {
+			t.Errorf("%s: current page %v, want %v", test.name, got, test.current)
+		}
+		if got := history.PreviousPage(); got != test.previous {
+			t.Errorf("%s: previous page %v, want %v", test.name, got, test.previous)
+		}
+	}
+	if got := history.PopDropped(); got != c {
+		t.Errorf("dropped page %v, want c", got)
+	}
+}
+
+func TestGetUpUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"gopher://host/1/a/b/c", "gopher://host/1/a/b"},
+		{"gopher://host/0/a/b.txt", "gopher://host/1/a"},
+		{"gopher://host/1/a/", "gopher://host"},
+		{"gopher://host/1/", "gopher://host"},
+		{"gopher://host", "gopher://host"},
+		{"gopher://host:7070/1/a/b", "gopher://host:7070/1/a"},
+		{"gopher://host/7/a/search%09term", "gopher://host/1/a"},
+		{"gophers://host/1/a/b", "gophers://host/1/a"},
+		{"gemini://host/a/b/c.gmi", "gemini://host/a/b/"},
+		{"gemini://host/a/b/", "gemini://host/a/"},
+		{"gemini://host/a/b?q=1", "gemini://host/a/"},
+		{"gemini://host/a", "gemini://host/"},
+		{"gemini://host/", "gemini://host/"},
+	}
+	for _, test := range tests {
+		if got := GetUpUrl(test.url); got != test.want {
+			t.Errorf("GetUpUrl(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestIPv6Urls(t *testing.T) {
+	tests := []struct {
+		url  string
+		up   string
+		root string
+	}{
+		{"gopher://[::1]/1/a/b", "gopher://[::1]/1/a", "gopher://[::1]"},
+		{"gopher://[::1]:7070/1/a", "gopher://[::1]:7070", "gopher://[::1]:7070"},
+		{"gemini://[2001:db8::1]/a/b", "gemini://[2001:db8::1]/a/", "gemini://[2001:db8::1]"},
+	}
+	for _, test := range tests {
+		if got := GetUpUrl(test.url); got != test.up {
+			t.Errorf("GetUpUrl(%q) = %q, want %q", test.url, got, test.up)
+		}
+		client := newTestClient(test.url)
+		client.Cache.Put(&core.Page{Type: core.TextType, Url: test.root})
+		client.CommandGoToRoot()
+		if got := client.HistoryManager.CurrentPage().Url; got != test.root {
+			t.Errorf("root of %q is %q, want %q", test.url, got, test.root)
+		}
+	}
+}
+
+// Config files are looked for in the XDG config directory, then the places
+// older versions used, and the first one that exists is read
+func TestFindConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home")
+	config_home := filepath.Join(dir, "config")
+	config_dirs := []string{filepath.Join(dir, "etc1"), filepath.Join(dir, "etc2")}
+	locations := []string{
+		filepath.Join(config_home, DEFAULT_CONFIG_PATH),
+		filepath.Join(config_home, LEGACY_CONFIG_PATH),
+		filepath.Join(config_dirs[0], LEGACY_CONFIG_PATH),
+		filepath.Join(config_dirs[1], LEGACY_CONFIG_PATH),
+		filepath.Join(home, HOME_CONFIG_PATH),
+		LOCAL_CONFIG_PATH,
+	}
+	got := configFileLocations(home, config_home, config_dirs)
+	if strings.Join(got, "\n") != strings.Join(locations, "\n") {
+		t.Fatalf("looked in %q, want %q", got, locations)
+	}
+	if got := configFileLocations("", config_home, nil); got[len(got)-2] != filepath.Join(config_home, LEGACY_CONFIG_PATH) {
+		t.Errorf("looked in %q without a home directory", got)
+	}
+
+	// Nothing exists yet, so a new file goes in the XDG directory
+	if got := findConfigFile(home, config_home, config_dirs); got != locations[0] {
+		t.Errorf("found %q without any config file, want %q", got, locations[0])
+	}
+	// Create the files least important first, each taking over from the last
+	for i := len(locations) - 2; i >= 0; i-- {
+		if err := os.MkdirAll(filepath.Dir(locations[i]), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(locations[i], []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := findConfigFile(home, config_home, config_dirs); got != locations[i] {
+			t.Errorf("found %q, want %q", got, locations[i])
+		}
+	}
+}
+
+func TestSplitUrlAnchor(t *testing.T) {
+	tests := []struct {
+		url    string
+		want   string
+		anchor string
+	}{
+		{"gopher://host/0/a.txt", "gopher://host/0/a.txt", ""},
+		{"gopher://host/0/a.txt#L42", "gopher://host/0/a.txt", "L42"},
+		{"gopher://host/0/a.txt#search=two%20words", "gopher://host/0/a.txt", "search=two words"},
+		// Fragments that don't point into the page stay in the url
+		{"gemini://host/page.gmi#section", "gemini://host/page.gmi#section", ""},
+		{"gopher://host/0/a.txt#L0", "gopher://host/0/a.txt#L0", ""},
+		{"gopher://host/0/a.txt#Lx", "gopher://host/0/a.txt#Lx", ""},
+		{"gopher://host/0/a.txt#search=", "gopher://host/0/a.txt#search=", ""},
+		{"gopher://host/0/a.txt#L%zz", "gopher://host/0/a.txt#L%zz", ""},
+	}
+	for _, test := range tests {
+		got, anchor := splitUrlAnchor(test.url)
+		if got != test.want || anchor != test.anchor {
+			t.Errorf("splitUrlAnchor(%q) = %q, %q, want %q, %q", test.url, got, anchor, test.want, test.anchor)
+		}
+	}
+}
+
+func TestApplyAnchor(t *testing.T) {
+	client := newTestClient("gopher://host/0/a.txt")
+	page := client.HistoryManager.CurrentPage()
+	page.Content = strings.Repeat("filler\n", 30) + "needle\n" + strings.Repeat("filler\n", 30)
+	client.PageView.PageText.SetRect(0, 0, 80, 10)
+	client.PageView.RenderPage(page)
+
+	client.applyAnchor("L20")
+	if row, _ := client.PageView.PageText.GetScrollOffset(); row != 19 {
+		t.Errorf("line 20 anchor scrolled to row %d, want 19", row)
+	}
+	client.applyAnchor("search=needle")
+	if client.searchQuery != "needle" || client.searchIndex != 0 || len(client.searchMatches) != 1 {
+		t.Errorf("search anchor found match %d of %d for %q, want the one needle",
+			client.searchIndex+1, len(client.searchMatches), client.searchQuery)
+	}
+}
+
+func TestLooksLikeHost(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"gopher.floodgap.com", true},
+		{"localhost", true},
+		{"localhost:7070", true},
+		{"localhost:7070/1/x", true},
+		{"example.org/1/phlog", true},
+		{"192.168.1.1", true},
+		{"192.168.1.1:70/1/", true},
+		{"reload", false},
+		{"1.2", false},
+		{"12", false},
+		{"host with space", false},
+		{"host.org:port", false},
+		{"gopher://host.org", false},
+		{"under_score.org", false},
+	}
+	for _, test := range tests {
+		if got := looksLikeHost(test.text); got != test.want {
+			t.Errorf("looksLikeHost(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
@@ -4,18 +4,66 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"git.mills.io/prologic/go-gopher"
 	"github.com/gdamore/tcell/v2"
+	"github.com/ottopasuuna/viscacha/core"
 	"github.com/rivo/tview"
 )
 
+// Region tags added by searches and selections, but not by the renderers
+var markRegionPattern = regexp.MustCompile(`\["(search-\d+|selection)?"\]`)
+
+// Columns an image is scaled to before the view has been drawn
+const DEFAULT_IMAGE_WIDTH = 80
+
 type PageView struct {
-	PageText   *tview.TextView
-	StatusLine *tview.TextView
-	currentUrl string
-	ansiWriter io.Writer
+	PageText     *tview.TextView
+	StatusLine   *tview.TextView
+	currentUrl   string
+	currentTitle string
+	currentType  core.ContentType
+	ansiWriter   io.Writer
+	LineNumbers  bool // Show line numbers for text files
+	Wrap         bool // Wrap long lines, otherwise they can be scrolled horizontally
+	Highlight    bool // Syntax highlight text files that look like source code
+	Theme        Theme
+	Raw          bool // Showing the content as received rather than rendered
+	RawMode      bool // Show directories and gemtext as received until turned off
+	// Make urls in gopher info lines into links. They are found again each
+	// time a directory is rendered, so turning it off takes them out of the
+	// page's links.
+	DetectInfoLinks    bool
+	HideLinkNumbers    bool   // Leave out the numbers of gopher directory items
+	Loading            string // Progress shown in the status line while a page loads
+	AutoreloadUrl      string // Page being reloaded every AutoreloadInterval
+	AutoreloadInterval time.Duration
+	Visited            map[string]bool // Links to urls in here are colored as visited
+	Selecting          bool            // Lines are being selected in visual mode
+	// The line the selection was started on and the line it was extended
+	// to, which comes before selectionStart when selecting upwards
+	selectionStart int
+	selectionEnd   int
+	// The line of text each numbered line starts on, when line numbers are
+	// shown, or each gemtext line. Their own wrapping splits them over
+	// several lines of text.
+	numberedLines []int
+	// The renderer wrapped the lines itself and the TextView doesn't wrap
+	// them, so lines that must not wrap can be scrolled sideways
+	prewrapped bool
+	// How images are drawn, one of the IMAGE_PROTOCOL constants other than
+	// auto. Kitty and sixel images are drawn by DrawGraphics.
+	ImageProtocol string
+	inlineImage   *inlineImage    // Image of the page shown, drawn with graphics
+	placement     *imagePlacement // Where DrawGraphics last drew it
+	textDrawn     bool            // PageText was drawn since the last DrawGraphics
+	// The screen the placement is on
+	graphicsScreen tcell.Screen
 }
 
 func NewPageView() *PageView {
@@ -27,56 +75,287 @@ func NewPageView() *PageView {
 	textView.SetBackgroundColor(tcell.ColorDefault)
 
 	statusLine := tview.NewTextView()
-	statusLine.SetTextColor(tcell.GetColor("black"))
-	statusLine.SetBackgroundColor(tcell.GetColor("white"))
 	pageview := &PageView{
-		PageText:   textView,
-		StatusLine: statusLine,
-		ansiWriter: tview.ANSIWriter(textView),
+		PageText:      textView,
+		StatusLine:    statusLine,
+		ansiWriter:    tview.ANSIWriter(textView),
+		Wrap:          true,
+		ImageProtocol: IMAGE_PROTOCOL_BLOCKS,
 	}
+	pageview.SetTheme(DefaultTheme)
+	// Graphics are only drawn while the page is, not under a dialog. The
+	// text view has no border or padding, so all of it is inside.
+	textView.SetDrawFunc(func(screen tcell.Screen, x int, y int, width int, height int) (int, int, int, int) {
+		pageview.textDrawn = true
+		return x, y, width, height
+	})
 	return pageview
 }
 
+// Use the colors of theme for pages rendered from now on and the status line
+func (pageview *PageView) SetTheme(theme Theme) {
+	pageview.Theme = theme
+	pageview.StatusLine.SetTextColor(tcell.GetColor(theme.StatusFg))
+	pageview.StatusLine.SetBackgroundColor(tcell.GetColor(theme.StatusBg))
+}
+
+// How much of the page has been seen, 100 when all of it fits in the view
 func (pageview *PageView) getPercentScroll() float64 {
-	_, _, _, height := pageview.PageText.GetRect()
+	_, _, _, height := pageview.PageText.GetInnerRect()
 	row, _ := pageview.PageText.GetScrollOffset()
 	viewBottom := row + height
 	numLines := pageview.NumLines()
-	percentViewed := math.Min(1.0, float64(viewBottom)/float64(numLines))
-	return percentViewed * 100
+	if numLines == 0 || viewBottom >= numLines {
+		return 100
+	}
+	return float64(viewBottom) / float64(numLines) * 100
 }
 
+// Number of lines of text, not counting the empty one after a final newline
 func (pageview *PageView) NumLines() int {
-	numLines := len(strings.Split(pageview.PageText.GetText(true), "\n"))
-	return numLines
+	text := strings.TrimSuffix(pageview.PageText.GetText(true), "\n")
+	if text == "" {
+		return 0
+	}
+	return strings.Count(text, "\n") + 1
 }
 
 func (p *PageView) UpdateStatus() {
 	p.StatusLine.Clear()
 	pctString := p.getPercentScroll()
 	_, _, width, _ := p.StatusLine.GetRect()
+	// Room left by " 100%"
 	available_for_url := width - 5
-	urlString := p.currentUrl
-	if len(urlString) > available_for_url {
-		urlString = urlString[:available_for_url]
+	if available_for_url < 0 {
+		available_for_url = 0
+	}
+	// Show the type and title first, the url is truncated first when space runs out
+	location := p.currentUrl
+	if p.currentTitle != "" {
+		location = fmt.Sprintf("%s | %s", p.currentTitle, p.currentUrl)
+	}
+	if p.currentUrl != "" {
+		type_label := p.currentType.String()
+		if p.Raw {
+			type_label = "RAW"
+		}
+		location = fmt.Sprintf("[%s] %s", type_label, location)
+	}
+	if p.AutoreloadUrl != "" && p.AutoreloadUrl == p.currentUrl {
+		location = fmt.Sprintf("↻ %v | %s", p.AutoreloadInterval, location)
+	}
+	if p.Loading != "" {
+		location = fmt.Sprintf("%s | %s", p.Loading, location)
+	}
+	locationRunes := []rune(location)
+	if len(locationRunes) > available_for_url && available_for_url > 0 {
+		locationRunes = append(locationRunes[:available_for_url-1], '…')
+	} else if len(locationRunes) > available_for_url {
+		locationRunes = nil
+	}
+	padding := strings.Repeat(" ", available_for_url-len(locationRunes))
+	fmt.Fprintf(p.StatusLine, "%s%s %3d%%", string(locationRunes), padding, int(pctString))
+}
+
+// Wrap each of the given lines in a region with the id "search-<n>", where n
+// is the line's position in lines, so that matches can be highlighted.
+// Regions from any previous search or selection are removed.
+func (pageview *PageView) MarkSearchMatches(lines []int) {
+	text := markRegionPattern.ReplaceAllString(pageview.taggedText(), "")
+	text_lines := strings.Split(text, "\n")
+	for n, line := range lines {
+		if line < len(text_lines) {
+			text_lines[line] = fmt.Sprintf(`["search-%d"]%s[""]`, n, text_lines[line])
+		}
+	}
+	row, col := pageview.PageText.GetScrollOffset()
+	pageview.PageText.SetText(strings.Join(text_lines, "\n"))
+	pageview.PageText.ScrollTo(row, col)
+}
+
+// Start selecting lines, beginning with the line at the top of the view
+func (pageview *PageView) StartSelection() {
+	row, _ := pageview.PageText.GetScrollOffset()
+	line := pageview.rowLine(row)
+	pageview.Selecting = true
+	pageview.selectionStart, pageview.selectionEnd = line, line
+	pageview.markSelection()
+}
+
+// Extend the selection by the given number of lines, negative to move it up,
+// scrolling to keep its end in view
+func (pageview *PageView) MoveSelection(lines int) {
+	end := pageview.selectionEnd + lines
+	if last_line := pageview.NumLines() - 1; end > last_line {
+		end = last_line
+	}
+	if end < 0 {
+		end = 0
+	}
+	pageview.selectionEnd = end
+	pageview.markSelection()
+
+	end_row := pageview.LineRows()[end]
+	_, _, _, height := pageview.PageText.GetInnerRect()
+	row, col := pageview.PageText.GetScrollOffset()
+	if end_row < row {
+		pageview.PageText.ScrollTo(end_row, col)
+	} else if height > 0 && end_row >= row+height {
+		pageview.PageText.ScrollTo(end_row-height+1, col)
+	}
+}
+
+// The selected lines as shown, without color tags
+func (pageview *PageView) SelectedText() string {
+	first, last := pageview.selectionRange()
+	lines := strings.Split(pageview.PageText.GetText(true), "\n")
+	if last >= len(lines) {
+		last = len(lines) - 1
+	}
+	if first > last {
+		return ""
 	}
-	padding := strings.Repeat(" ", available_for_url-len(urlString))
-	fmt.Fprintf(p.StatusLine, "%s%s %3d%%", urlString, padding, int(pctString))
+	return strings.Join(lines[first:last+1], "\n")
+}
+
+// Leave visual mode and remove the selection's highlight
+func (pageview *PageView) EndSelection() {
+	pageview.Selecting = false
+	text := markRegionPattern.ReplaceAllString(pageview.taggedText(), "")
+	row, col := pageview.PageText.GetScrollOffset()
+	pageview.PageText.SetText(text)
+	pageview.PageText.ScrollTo(row, col)
+	pageview.PageText.Highlight()
+}
+
+// First and last selected line, in the order they appear on the page
+func (pageview *PageView) selectionRange() (int, int) {
+	if pageview.selectionEnd < pageview.selectionStart {
+		return pageview.selectionEnd, pageview.selectionStart
+	}
+	return pageview.selectionStart, pageview.selectionEnd
+}
+
+// Wrap the selected lines in the "selection" region and highlight it.
+// Search regions are removed, since regions can't overlap.
+func (pageview *PageView) markSelection() {
+	first, last := pageview.selectionRange()
+	text := markRegionPattern.ReplaceAllString(pageview.taggedText(), "")
+	text_lines := strings.Split(text, "\n")
+	if last < len(text_lines) {
+		text_lines[first] = `["selection"]` + text_lines[first]
+		text_lines[last] = text_lines[last] + `[""]`
+	}
+	row, col := pageview.PageText.GetScrollOffset()
+	pageview.PageText.SetText(strings.Join(text_lines, "\n"))
+	pageview.PageText.ScrollTo(row, col)
+	pageview.PageText.Highlight("selection")
+}
+
+// Scroll so the given line, counting from 1, is at the top of the view.
+// Lines are counted as numbered when line numbers are shown, otherwise as
+// they are written, so a wrapped line counts once.
+// Returns false if there is no such line.
+func (pageview *PageView) ScrollToLine(line int) bool {
+	text_line := line - 1
+	if pageview.numberedLines != nil {
+		if text_line < 0 || text_line >= len(pageview.numberedLines) {
+			return false
+		}
+		text_line = pageview.numberedLines[text_line]
+	} else if text_line < 0 || text_line >= pageview.NumLines() {
+		return false
+	}
+	_, col := pageview.PageText.GetScrollOffset()
+	pageview.PageText.ScrollTo(pageview.LineRows()[text_line], col)
+	return true
+}
+
+// The line of text shown on the given row of the TextView
+func (pageview *PageView) rowLine(row int) int {
+	line := 0
+	for i, line_row := range pageview.LineRows() {
+		if line_row > row {
+			break
+		}
+		line = i
+	}
+	return line
+}
+
+// The text of the view with its color and region tags, for changing and
+// setting again. GetText(false) adds a newline to the end each time.
+func (pageview *PageView) taggedText() string {
+	return strings.TrimSuffix(pageview.PageText.GetText(false), "\n")
+}
+
+func (pageview *PageView) SetWrap(wrap bool) {
+	pageview.Wrap = wrap
+	pageview.PageText.SetWrap(wrap)
+}
+
+// Whether the TextView wraps long lines, rather than them being scrolled
+// sideways
+func (pageview *PageView) textWraps() bool {
+	return pageview.Wrap && !pageview.prewrapped
+}
+
+// The row of the TextView each line of its text starts on, which differs
+// from the line number once long lines are wrapped
+func (pageview *PageView) LineRows() []int {
+	lines := strings.Split(pageview.PageText.GetText(false), "\n")
+	rows := make([]int, len(lines))
+	_, _, width, _ := pageview.PageText.GetInnerRect()
+	row := 0
+	for i, line := range lines {
+		rows[i] = row
+		if pageview.textWraps() && width > 0 && line != "" {
+			row += len(tview.WordWrap(line, width))
+		} else {
+			row += 1
+		}
+	}
+	return rows
 }
 
 func (pageview *PageView) Clear() {
+	pageview.Selecting = false
+	pageview.numberedLines = nil
+	pageview.prewrapped = false
+	pageview.PageText.SetWrap(pageview.Wrap)
+	pageview.inlineImage = nil
 	pageview.PageText.Clear()
 	pageview.StatusLine.Clear()
 }
 
-func (pageview *PageView) RenderPage(page *Page) {
+// Render page, or show it as received if RawMode is on and it has markup
+func (pageview *PageView) RenderPage(page *core.Page) {
+	switch page.Type {
+	case core.GopherDirectory, core.GopherQuery, core.GemtextType:
+		if pageview.RawMode {
+			pageview.RenderRaw(page)
+			return
+		}
+	}
+	pageview.RenderFormatted(page)
+}
+
+// Render page with its links and colors, even in RawMode
+func (pageview *PageView) RenderFormatted(page *core.Page) {
 	pageview.Clear()
 	pageview.currentUrl = page.Url
+	pageview.currentTitle = page.Title
+	pageview.currentType = page.Type
+	pageview.Raw = false
 	switch page.Type {
-	case TextType:
+	case core.TextType:
 		pageview.RenderTextFile(page)
-	case GopherDirectory:
+	case core.GopherDirectory, core.GopherQuery:
 		pageview.RenderGopherDirectory(page)
+	case core.GemtextType:
+		pageview.RenderGemtext(page)
+	case core.ImageType:
+		pageview.RenderImage(page)
 	default:
 		fmt.Fprintf(pageview.PageText, "[red] page type not recognized \"%d\"[white]", page.Type)
 		AppLog.Error("[red] page type not recognized \"%d\"[white]\n", page.Type)
@@ -84,41 +363,196 @@ func (pageview *PageView) RenderPage(page *Page) {
 	pageview.UpdateStatus()
 }
 
-func (pageview *PageView) RenderTextFile(page *Page) {
-	content := strings.ReplaceAll(page.Content, "%", "%%")
-	content = tview.Escape(content)
-	fmt.Fprintf(pageview.ansiWriter, content)
+// Show the content of page exactly as it was received, without parsing links
+// or colors. Useful for seeing the tab separated fields of a gophermap.
+// Pages made up by viscacha, like filtered directories, have nothing received
+// to show, so their content is shown instead.
+func (pageview *PageView) RenderRaw(page *core.Page) {
+	pageview.Clear()
+	pageview.currentUrl = page.Url
+	pageview.currentTitle = page.Title
+	pageview.currentType = page.Type
+	pageview.Raw = true
+	content := page.Content
+	if page.Raw != nil {
+		content = string(page.Raw)
+	}
+	fmt.Fprint(pageview.PageText, tview.Escape(content))
+	pageview.PageText.ScrollTo(page.ScrollOffset, 0)
+	pageview.UpdateStatus()
+}
+
+func (pageview *PageView) RenderTextFile(page *core.Page) {
+	if strings.TrimSpace(page.Content) == "" {
+		pageview.renderEmpty("file")
+		return
+	}
+	var lang *syntax
+	if pageview.Highlight {
+		lang = detectSyntax(page.Url, page.Content)
+	}
+	if lang != nil {
+		// The highlighter escapes the text itself, so it must not go
+		// through Fprintf or the ANSI writer
+		lines := lang.highlight(page.Content)
+		if pageview.LineNumbers {
+			pageview.renderNumberedLines(lines)
+		} else {
+			fmt.Fprint(pageview.PageText, strings.Join(lines, "\n"))
+		}
+		pageview.PageText.ScrollTo(page.ScrollOffset, 0)
+		return
+	}
+	if pageview.LineNumbers {
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSuffix(page.Content, "\n"), "\n") {
+			lines = append(lines, tview.TranslateANSI(tview.Escape(strings.TrimSuffix(line, "\r"))))
+		}
+		pageview.renderNumberedLines(lines)
+		pageview.PageText.ScrollTo(page.ScrollOffset, 0)
+		return
+	}
+	// Written as is, so nothing in the content is read as a format verb.
+	// Escaping is still needed so "[red]" isn't taken as a color tag.
+	io.WriteString(pageview.ansiWriter, tview.Escape(page.Content))
 	pageview.PageText.ScrollTo(page.ScrollOffset, 0)
 }
 
-func (pageview *PageView) RenderGopherDirectory(page *Page) {
+// Show an image scaled down to fit the width of the view. With kitty or
+// sixel graphics blank lines are left for DrawGraphics to draw it over,
+// otherwise it is drawn with colored half block characters, two pixels to
+// each character cell, which works everywhere that colors do. Half blocks
+// are only used when asked for. Without a protocol, images are downloaded
+// instead of fetched, so only one loaded before image_protocol changed
+// gets here.
+func (pageview *PageView) RenderImage(page *core.Page) {
+	if page.Image == nil {
+		return
+	}
+	if pageview.ImageProtocol == IMAGE_PROTOCOL_NONE {
+		bounds := page.Image.Bounds()
+		fmt.Fprintf(pageview.PageText, "%dx%d image, not shown without an image_protocol\n",
+			bounds.Dx(), bounds.Dy())
+		return
+	}
+	_, _, width, _ := pageview.PageText.GetInnerRect()
+	if width <= 0 {
+		width = DEFAULT_IMAGE_WIDTH
+	}
+	if pageview.ImageProtocol != IMAGE_PROTOCOL_BLOCKS {
+		pageview.inlineImage = newInlineImage(page.Image, pageview.ImageProtocol, width)
+	}
+	if pageview.inlineImage != nil {
+		fmt.Fprint(pageview.PageText, strings.Repeat("\n", pageview.inlineImage.rows))
+		pageview.PageText.ScrollTo(page.ScrollOffset, 0)
+		return
+	}
+	bounds := page.Image.Bounds()
+	columns := bounds.Dx()
+	if columns > width {
+		columns = width
+	}
+	if columns == 0 {
+		return
+	}
+	scale := float64(bounds.Dx()) / float64(columns)
+	rows := int(math.Ceil(float64(bounds.Dy()) / scale / 2))
+	pixel := func(column int, pixel_row int) string {
+		x := bounds.Min.X + int((float64(column)+0.5)*scale)
+		y := bounds.Min.Y + int((float64(pixel_row)+0.5)*scale)
+		if y >= bounds.Max.Y {
+			return "-"
+		}
+		r, g, b, _ := page.Image.At(x, y).RGBA()
+		return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+	}
+	var text strings.Builder
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns; column++ {
+			fmt.Fprintf(&text, "[%s:%s]▀", pixel(column, 2*row), pixel(column, 2*row+1))
+		}
+		text.WriteString("[-:-]\n")
+	}
+	fmt.Fprint(pageview.PageText, text.String())
+	pageview.PageText.ScrollTo(page.ScrollOffset, 0)
+}
+
+// Write already formatted lines with a line number in front of each one.
+// Lines are wrapped here rather than by the TextView so wrapped lines are
+// indented past the line numbers.
+func (pageview *PageView) renderNumberedLines(lines []string) {
+	_, _, width, _ := pageview.PageText.GetInnerRect()
+	n_digits := len(strconv.Itoa(len(lines)))
+	gutter_width := n_digits + 1
+	text_line := 0
+	for i, line := range lines {
+		pageview.numberedLines = append(pageview.numberedLines, text_line)
+		wrapped := []string{line}
+		if pageview.Wrap && width > gutter_width && line != "" {
+			wrapped = tview.WordWrap(line, width-gutter_width)
+		}
+		for j, segment := range wrapped {
+			if j == 0 {
+				fmt.Fprintf(pageview.PageText, "[gray]%*d[-] ", n_digits, i+1)
+			} else {
+				fmt.Fprint(pageview.PageText, strings.Repeat(" ", gutter_width))
+			}
+			fmt.Fprintln(pageview.PageText, segment)
+			text_line += 1
+		}
+	}
+}
+
+func (pageview *PageView) RenderGopherDirectory(page *core.Page) {
 	textview := pageview.ansiWriter
+	lines := strings.Split(page.Content, "\n")
+	items := make([]*gopher.Item, len(lines)) // nil for lines that aren't items
+	for line_num, line := range lines {
+		if item, err := gopher.ParseItem(line); err == nil {
+			items[line_num] = item
+		}
+	}
+	info_matches := pageview.findInfoLinks(page, items)
 	link_counter := 1
 	n_link_digits := int(math.Max(math.Log10(float64(len(page.Links))), 0)) + 1
-	link_format := fmt.Sprintf("[green]%%s [%%%dd][white] ", n_link_digits)
-	for _, line := range strings.Split(page.Content, "\n") {
-		item, err := gopher.ParseItem(line)
-		if err != nil {
+	theme := pageview.Theme
+	link_format := fmt.Sprintf("[%s]%%s [%%%dd][%s] ", theme.Link, n_link_digits, theme.Text)
+	info_indent := 3 + 1 + 2 + n_link_digits + 1
+	if pageview.HideLinkNumbers {
+		link_format = fmt.Sprintf("[%s]%%s[%s] ", theme.Link, theme.Text)
+		info_indent = 3 + 1
+	}
+	n_items := 0
+	// Every line of the directory is rendered as exactly one line
+	for line_num, item := range items {
+		if item == nil {
 			fmt.Fprintln(textview)
 			continue
 		}
-		if item.Type != gopher.INFO {
-			fmt.Fprintf(textview, link_format, item.Type.String(), link_counter)
-			link_counter += 1
+		n_items += 1
+		if item.Type == gopher.INFO {
+			pageview.renderInfoLine(item.Description, info_matches[line_num], info_indent, link_counter)
+			link_counter += len(info_matches[line_num])
+			continue
+		}
+		if pageview.HideLinkNumbers {
+			fmt.Fprintf(textview, link_format, item.Type.String())
 		} else {
-			fmt.Fprintf(textview, strings.Repeat(" ", 3+1+2+n_link_digits+1))
+			fmt.Fprintf(textview, link_format, item.Type.String(), link_counter)
 		}
+		link_index := link_counter - 1
+		link_counter += 1
 		var txt_color string
-		downloadable_color := "[orange]"
+		downloadable_color := theme.Binary
 		switch item.Type {
-		case gopher.INFO:
-			txt_color = "[white]"
 		case gopher.FILE:
-			txt_color = "[white]"
+			txt_color = theme.Text
 		case gopher.DIRECTORY:
-			txt_color = "[skyblue]"
+			txt_color = theme.Directory
 		case gopher.INDEXSEARCH:
-			txt_color = "[violet]"
+			txt_color = theme.Query
+		case gopher.HTML:
+			txt_color = theme.HTML
 		case gopher.IMAGE:
 			txt_color = downloadable_color
 		case gopher.PNG:
@@ -134,9 +568,205 @@ func (pageview *PageView) RenderGopherDirectory(page *Page) {
 		case gopher.DOC:
 			txt_color = downloadable_color
 		default:
-			txt_color = "[red]"
+			txt_color = theme.Unknown
+		}
+		if link_index < len(page.Links) && pageview.Visited[page.Links[link_index].Url] {
+			txt_color = theme.Visited
+		}
+		fmt.Fprintf(textview, "[%s]%s\n[%s]", txt_color, tview.Escape(item.Description), theme.Text)
+	}
+	if n_items == 0 {
+		pageview.PageText.Clear()
+		pageview.renderEmpty("directory")
+		return
+	}
+	pageview.PageText.ScrollTo(page.ScrollOffset, 0)
+}
+
+// Say that a page has nothing in it, rather than leaving the view blank
+func (pageview *PageView) renderEmpty(what string) {
+	fmt.Fprintf(pageview.PageText, "[%s](empty %s)[-]\n", pageview.Theme.Info, what)
+}
+
+// Put the links of urls in info lines into the page's links, in the order
+// they are numbered in, if DetectInfoLinks is set, and take out the ones
+// found when it was last rendered. The links of items are kept as they are,
+// so pages like bookmarks can have links of their own. LinkLines is set to
+// the line of each link. Returns the urls found in each line.
+func (pageview *PageView) findInfoLinks(page *core.Page, items []*gopher.Item) [][][]int {
+	is_info_line := func(line_num int) bool {
+		return line_num < len(items) && items[line_num] != nil && items[line_num].Type == gopher.INFO
+	}
+	// Handlers and pages made up by viscacha only link items
+	var item_links []*core.Link
+	for i, link := range page.Links {
+		if i >= len(page.LinkLines) || !is_info_line(page.LinkLines[i]) {
+			item_links = append(item_links, link)
+		}
+	}
+	info_matches := make([][][]int, len(items))
+	var links []*core.Link
+	var link_lines []int
+	for line_num, item := range items {
+		if item == nil {
+			continue
+		}
+		if item.Type != gopher.INFO {
+			// Items past the end of the links are still numbered, but
+			// there's nothing to follow
+			if len(item_links) > 0 {
+				links = append(links, item_links[0])
+				item_links = item_links[1:]
+			}
+			link_lines = append(link_lines, line_num)
+			continue
+		}
+		if !pageview.DetectInfoLinks {
+			continue
+		}
+		info_matches[line_num] = core.FindInfoLinks(item.Description)
+		for _, match := range info_matches[line_num] {
+			links = append(links, core.InfoLink(item.Description[match[0]:match[1]]))
+			link_lines = append(link_lines, line_num)
+		}
+	}
+	page.Links = links
+	page.LinkLines = link_lines
+	return info_matches
+}
+
+// Write an info line exactly as the server sent it, indented to line up with
+// link descriptions, so ASCII art banners keep their columns. Only bracketed
+// text that tview would read as a color or region tag gets escaped.
+// The urls at matches in the line are numbered from link_num. The numbers go
+// after the text rather than in front of the urls, so a url in a banner
+// doesn't push the rest of its line out of place.
+func (pageview *PageView) renderInfoLine(description string, matches [][]int, indent int, link_num int) {
+	theme := pageview.Theme
+	var line strings.Builder
+	last := 0
+	for _, match := range matches {
+		line.WriteString(tview.Escape(description[last:match[0]]))
+		fmt.Fprintf(&line, "[%s]%s[%s]", theme.Directory,
+			tview.Escape(description[match[0]:match[1]]), theme.Info)
+		last = match[1]
+	}
+	line.WriteString(tview.Escape(description[last:]))
+	if !pageview.HideLinkNumbers {
+		for i := range matches {
+			fmt.Fprintf(&line, " [%s][%d]", theme.Link, link_num+i)
+		}
+	}
+	fmt.Fprint(pageview.ansiWriter, strings.Repeat(" ", indent), "["+theme.Info+"]", line.String(), "\n")
+}
+
+// Split a gemtext link line "=> URL [label]" into its url and label.
+// The label is empty if the line doesn't have one.
+func parseGemtextLink(line string) (string, string) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "=>"))
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[0], strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+}
+
+func (pageview *PageView) RenderGemtext(page *core.Page) {
+	if strings.TrimSpace(page.Content) == "" {
+		page.Links = nil
+		page.LinkLines = nil
+		pageview.renderEmpty("page")
+		return
+	}
+	lines := strings.Split(page.Content, "\n")
+	n_links := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "=>") {
+			n_links += 1
+		}
+	}
+	n_link_digits := int(math.Max(math.Log10(float64(n_links)), 0)) + 1
+	theme := pageview.Theme
+	link_format := fmt.Sprintf("[%s]=> [%%%dd][%s] ", theme.Link, n_link_digits, theme.Text)
+	base_url, base_err := url.Parse(page.Url)
+
+	// tview can only toggle wrapping for the whole TextView, so lines are
+	// wrapped here and the TextView doesn't wrap, leaving preformatted
+	// lines whole to be scrolled sideways. Before the view has a width it
+	// wraps everything, until it is rendered again once drawn.
+	width := 0
+	if pageview.Wrap {
+		_, _, width, _ = pageview.PageText.GetInnerRect()
+	}
+	if width > 0 {
+		pageview.prewrapped = true
+		pageview.PageText.SetWrap(false)
+	}
+	text_line := 0
+	writeLine := func(line string, wrap bool) {
+		pageview.numberedLines = append(pageview.numberedLines, text_line)
+		segments := []string{line}
+		if wrap && width > 0 && line != "" {
+			segments = tview.WordWrap(line, width)
+		}
+		for _, segment := range segments {
+			fmt.Fprintln(pageview.PageText, segment)
+			text_line += 1
+		}
+	}
+	// Lines are formatted and escaped before being wrapped, so ANSI colors
+	// are translated here rather than by the ANSI writer
+	text := func(line string) string {
+		return tview.TranslateANSI(tview.Escape(line))
+	}
+
+	// Links are discovered while rendering, so rebuild them each time the
+	// page is rendered rather than appending duplicates on back/forward.
+	page.Links = nil
+	page.LinkLines = nil
+	preformatted := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "```") {
+			preformatted = !preformatted
+			continue
+		}
+		if preformatted {
+			writeLine(text(line), false)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "=>"):
+			link_url, label := parseGemtextLink(line)
+			if link_url == "" {
+				writeLine("", true)
+				continue
+			}
+			if base_err == nil {
+				if ref, err := base_url.Parse(link_url); err == nil {
+					link_url = ref.String()
+				}
+			}
+			if label == "" {
+				label = link_url
+			}
+			page.Links = append(page.Links, &core.Link{Type: core.UrlContentType(link_url), Url: link_url, Description: label})
+			page.LinkLines = append(page.LinkLines, text_line)
+			label_color := theme.Directory
+			if pageview.Visited[link_url] {
+				label_color = theme.Visited
+			}
+			writeLine(fmt.Sprintf(link_format, len(page.Links))+
+				fmt.Sprintf("[%s]%s[%s]", label_color, text(label), theme.Text), true)
+		case strings.HasPrefix(line, "###"):
+			writeLine("[yellow]"+text(line)+"[white]", true)
+		case strings.HasPrefix(line, "##"):
+			writeLine("[orange::b]"+text(line)+"[white::-]", true)
+		case strings.HasPrefix(line, "#"):
+			writeLine("[fuchsia::b]"+text(line)+"[white::-]", true)
+		default:
+			writeLine(text(line), true)
 		}
-		fmt.Fprintf(textview, "%s%s\n[white]", txt_color, tview.Escape(item.Description))
 	}
 	pageview.PageText.ScrollTo(page.ScrollOffset, 0)
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/ottopasuuna/viscacha/core"
+)
+
+func TestRawModeShowsReceivedBytes(t *testing.T) {
+	pageView := NewPageView()
+	pageView.RawMode = true
+	page := &core.Page{
+		Type:    core.GopherDirectory,
+		Url:     "gopher://host/1/",
+		Content: "Rebuilt content\n",
+		Raw:     []byte("iReceived\tfake\t(NULL)\t0\r\n.\r\n"),
+	}
+	pageView.RenderPage(page)
+	if got := pageView.PageText.GetText(true); !strings.HasPrefix(got, "iReceived") {
+		t.Errorf("raw mode shows %q, want what was received", got)
+	}
+	// Made up pages have nothing received to show
+	page.Raw = nil
+	pageView.RenderPage(page)
+	if got := pageView.PageText.GetText(true); got != "Rebuilt content\n" {
+		t.Errorf("raw mode shows %q, want the content", got)
+	}
+}
+
+// Info lines keep their columns on screen, whatever brackets or urls are in
+// them, so ASCII art banners line up
+func TestInfoLineBannerAlignment(t *testing.T) {
+	banner := []string{
+		"+--[ Welcome ]--+",
+		"| [x] [ ] [[a]] |",
+		"| [red] [-] []] |",
+		"| [\"r\"] [a:b:c] |",
+		"| ╔═╗ [#ff0000] |",
+		"| gopher://a.b/ |",
+		"+---------------+",
+	}
+	var content strings.Builder
+	for _, line := range banner {
+		content.WriteString("i" + line + "\tfake\t(NULL)\t0\r\n")
+	}
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Fini()
+	screen.SetSize(80, 24)
+	pageView := NewPageView()
+	pageView.DetectInfoLinks = true
+	pageView.PageText.SetRect(0, 0, 80, 20)
+	pageView.RenderPage(&core.Page{
+		Type:    core.GopherDirectory,
+		Url:     "gopher://host/1/",
+		Content: content.String(),
+		Links:   []*core.Link{{Url: "gopher://a.b/"}},
+	})
+	pageView.PageText.Draw(screen)
+	screen.Show()
+	cells, width, _ := screen.GetContents()
+	indent := 3 + 1 + 2 + 1 + 1
+	for y, line := range banner {
+		var row strings.Builder
+		for x := indent; x < indent+len([]rune(line)); x++ {
+			row.WriteString(string(cells[y*width+x].Runes))
+		}
+		if row.String() != line {
+			t.Errorf("line %d drawn as %q, want %q", y+1, row.String(), line)
+		}
+	}
+}
+
+// The numbers shown for urls in info lines are the ones that follow them,
+// whether detect_info_links was on when the page was fetched or not
+func TestInfoLinksFollowSetting(t *testing.T) {
+	page := &core.Page{
+		Type: core.GopherDirectory,
+		Url:  "gopher://host/1/",
+		Content: "iSee gopher://a.b/ and gemini://c.d/\tfake\t(NULL)\t0\r\n" +
+			"0Notes\t/notes.txt\thost\t70\r\n",
+		Links:     []*core.Link{{Type: core.TextType, Url: "gopher://host/0/notes.txt"}},
+		LinkLines: []int{1},
+	}
+	pageView := NewPageView()
+	pageView.PageText.SetRect(0, 0, 80, 20)
+	for _, detect := range []bool{true, false, true} {
+		pageView.DetectInfoLinks = detect
+		pageView.RenderPage(page)
+		text := pageView.PageText.GetText(true)
+		want := []string{"gopher://host/0/notes.txt"}
+		if detect {
+			want = []string{"gopher://a.b/", "gemini://c.d/", "gopher://host/0/notes.txt"}
+		}
+		if len(page.Links) != len(want) {
+			t.Fatalf("detect %v: got %d links, want %d", detect, len(page.Links), len(want))
+		}
+		for i, link := range page.Links {
+			if link.Url != want[i] {
+				t.Errorf("detect %v: link %d is %s, want %s", detect, i+1, link.Url, want[i])
+			}
+			number := fmt.Sprintf("[%d]", i+1)
+			if !strings.Contains(text, number) {
+				t.Errorf("detect %v: %s not shown in %q", detect, number, text)
+			}
+		}
+		if strings.Contains(text, fmt.Sprintf("[%d]", len(want)+1)) {
+			t.Errorf("detect %v: more links numbered than there are in %q", detect, text)
+		}
+		// The notes item is numbered after the info line's urls
+		if !strings.Contains(text, fmt.Sprintf("[%d] Notes", len(want))) {
+			t.Errorf("detect %v: notes item not link %d in %q", detect, len(want), text)
+		}
+		if items := core.GopherDirectoryItems(page); len(items) != 1 || items[0].Links[0] != page.Links[len(want)-1] {
+			t.Errorf("detect %v: items %+v, want the notes item with its link", detect, items)
+		}
+	}
+}
+
+// Gemtext is wrapped to the width of the view, except preformatted lines,
+// which are left whole to be scrolled sideways
+func TestGemtextPreformattedNotWrapped(t *testing.T) {
+	pageView := NewPageView()
+	pageView.PageText.SetRect(0, 0, 20, 10)
+	art := "|  \\  long ascii art line  //  |"
+	page := &core.Page{
+		Type:    core.GemtextType,
+		Url:     "gemini://host/",
+		Content: "A paragraph long enough to wrap\n```\n" + art + "\n```\n=> /next Next\n",
+	}
+	pageView.RenderPage(page)
+	got := strings.Split(strings.TrimRight(pageView.PageText.GetText(true), "\n"), "\n")
+	want := []string{"A paragraph long", "enough to wrap", art, "=> [1] Next"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+	if len(page.LinkLines) != 1 || page.LinkLines[0] != 3 {
+		t.Errorf("link lines %v, want [3]", page.LinkLines)
+	}
+	if rows := pageView.LineRows(); len(rows) < 4 || rows[3] != 3 {
+		t.Errorf("line rows %v, the link should be on row 3", rows)
+	}
+	// Lines count as written when going to a line
+	if !pageView.ScrollToLine(2) {
+		t.Fatal("no line 2")
+	}
+	if row, _ := pageView.PageText.GetScrollOffset(); row != 2 {
+		t.Errorf("line 2 is on row %d, want 2", row)
+	}
+}
+
+func TestPercentScroll(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		scroll    int
+		num_lines int
+		percent   float64
+	}{
+		{"empty page", "", 0, 0, 100},
+		{"one line", "only line\n", 0, 1, 100},
+		{"one line without a newline", "only line", 0, 1, 100},
+		{"exactly the view's height", strings.Repeat("line\n", 10), 0, 10, 100},
+		{"twice the view's height", strings.Repeat("line\n", 20), 0, 20, 50},
+		{"scrolled to the end", strings.Repeat("line\n", 20), 10, 20, 100},
+	}
+	for _, test := range tests {
+		pageView := NewPageView()
+		pageView.PageText.SetRect(0, 0, 80, 10)
+		pageView.PageText.SetText(test.content)
+		pageView.PageText.ScrollTo(test.scroll, 0)
+		if got := pageView.NumLines(); got != test.num_lines {
+			t.Errorf("%s: %d lines, want %d", test.name, got, test.num_lines)
+		}
+		if got := pageView.getPercentScroll(); got != test.percent {
+			t.Errorf("%s: scrolled %v%%, want %v%%", test.name, got, test.percent)
+		}
+	}
+}
+
+// The status line without the newline GetText adds
+func statusText(pageView *PageView) string {
+	return strings.TrimSuffix(pageView.StatusLine.GetText(false), "\n")
+}
+
+// The status line fits the view, cutting the url short with an ellipsis
+func TestUpdateStatusTruncates(t *testing.T) {
+	pageView := NewPageView()
+	pageView.RenderPage(&core.Page{Type: core.TextType, Url: "gopher://example.org/0/a/rather/long/path.txt", Content: "text\n"})
+	for _, width := range []int{80, 40, 20, 10, 6} {
+		pageView.StatusLine.SetRect(0, 0, width, 1)
+		pageView.UpdateStatus()
+		status := []rune(statusText(pageView))
+		if len(status) != width {
+			t.Errorf("width %d: status %q is %d wide", width, string(status), len(status))
+		}
+		if !strings.HasSuffix(string(status), " 100%") {
+			t.Errorf("width %d: status %q doesn't end with the scroll percentage", width, string(status))
+		}
+		if width < 60 && !strings.HasSuffix(string(status), "… 100%") {
+			t.Errorf("width %d: status %q not cut short with an ellipsis", width, string(status))
+		}
+	}
+}
+
+// Too narrow for the url, or exactly wide enough for it
+func TestUpdateStatusNarrowAndExactFit(t *testing.T) {
+	pageView := NewPageView()
+	pageView.RenderPage(&core.Page{Type: core.TextType, Url: "gopher://host/0/a.txt", Content: "text\n"})
+	for _, width := range []int{4, 0} {
+		pageView.StatusLine.SetRect(0, 0, width, 1)
+		pageView.UpdateStatus()
+		if got := statusText(pageView); got != " 100%" {
+			t.Errorf("width %d: status %q, want only the scroll percentage", width, got)
+		}
+	}
+	location := "[TXT] gopher://host/0/a.txt"
+	pageView.StatusLine.SetRect(0, 0, len(location)+5, 1)
+	pageView.UpdateStatus()
+	if got := statusText(pageView); got != location+" 100%" {
+		t.Errorf("status %q, want the whole url", got)
+	}
+}
+
+// Text is never read as a format string
+func TestRenderTextFileFormatVerbs(t *testing.T) {
+	content := "100% done, %s %d %v %%\n"
+	for _, line_numbers := range []bool{false, true} {
+		pageView := NewPageView()
+		pageView.LineNumbers = line_numbers
+		pageView.PageText.SetRect(0, 0, 80, 20)
+		pageView.RenderPage(&core.Page{Type: core.TextType, Url: "gopher://host/0/a.txt", Content: content})
+		if got := pageView.PageText.GetText(true); !strings.Contains(got, strings.TrimSuffix(content, "\n")) {
+			t.Errorf("line numbers %v: rendered %q, want %q", line_numbers, got, content)
+		}
+	}
+}
+
+// Empty pages say so rather than showing nothing
+func TestRenderEmptyPages(t *testing.T) {
+	tests := []struct {
+		page *core.Page
+		want string
+	}{
+		{&core.Page{Type: core.GopherDirectory, Url: "gopher://host/1/empty", Content: ""}, "(empty directory)"},
+		{&core.Page{Type: core.GopherDirectory, Url: "gopher://host/1/empty", Content: "\n"}, "(empty directory)"},
+		{&core.Page{Type: core.TextType, Url: "gopher://host/0/empty.txt", Content: ""}, "(empty file)"},
+		{&core.Page{Type: core.TextType, Url: "gopher://host/0/blank.txt", Content: " \n\n"}, "(empty file)"},
+		{&core.Page{Type: core.GemtextType, Url: "gemini://host/empty.gmi", Content: ""}, "(empty page)"},
+	}
+	for _, test := range tests {
+		pageView := NewPageView()
+		pageView.PageText.SetRect(0, 0, 80, 10)
+		pageView.RenderPage(test.page)
+		if got := strings.TrimSpace(pageView.PageText.GetText(true)); got != test.want {
+			t.Errorf("%s rendered as %q, want %q", test.page.Url, got, test.want)
+		}
+		if got := pageView.getPercentScroll(); got != 100 {
+			t.Errorf("%s scrolled %v%%, want 100%%", test.page.Url, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/ottopasuuna/viscacha/core"
+)
+
+// Relative to the XDG data directory
+const DEFAULT_SESSION_PATH = "viscacha/session.json"
+
+// The tabs that were open when viscacha last quit
+type Session struct {
+	Tabs      []string `json:"tabs"` // Url of the current page of each tab
+	ActiveTab int      `json:"active_tab"`
+}
+
+// Read a session saved by Save. Returns nil if there is no session, or if
+// the file can't be used, so a broken file never stops viscacha starting.
+func LoadSession(path string) *Session {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		AppLog.Errorf("Failed to read session file \"%s\"\n\t%v", path, err)
+		return nil
+	}
+	session := &Session{}
+	err = json.Unmarshal(content, session)
+	if err != nil {
+		AppLog.Errorf("Failed to parse session file \"%s\"\n\t%v", path, err)
+		return nil
+	}
+	if len(session.Tabs) == 0 {
+		return nil
+	}
+	return session
+}
+
+// Write the session to a temporary file first and move it into place, so
+// the old session is kept if writing is interrupted.
+func (session *Session) Save(path string) error {
+	content, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// The url shown in each tab. Pages that can't be fetched again, like the
+// bookmarks list, are left out.
+func (c *Client) CurrentSession() *Session {
+	session := &Session{}
+	for i, tab := range c.Tabs {
+		tab_url := tab.restore_url
+		if page := tab.CurrentPage(); page != nil {
+			tab_url = page.Url
+		}
+		parsed_url, err := url.Parse(tab_url)
+		if err != nil || core.SchemeHandlers[parsed_url.Scheme] == nil {
+			continue
+		}
+		if i == c.activeTab {
+			session.ActiveTab = len(session.Tabs)
+		}
+		session.Tabs = append(session.Tabs, tab_url)
+	}
+	return session
+}
+
+// Replace the open tabs with the ones from session. Only the active tab is
+// loaded now, the others are loaded when they are first switched to.
+func (c *Client) RestoreSession(session *Session) {
+	c.Tabs = nil
+	for _, tab_url := range session.Tabs {
+		c.Tabs = append(c.Tabs, &HistoryManager{restore_url: tab_url})
+	}
+	active_tab := session.ActiveTab
+	if active_tab < 0 || active_tab >= len(c.Tabs) {
+		active_tab = 0
+	}
+	c.SwitchTab(active_tab)
+}